@@ -0,0 +1,508 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	redis "gopkg.in/redis.v3"
+)
+
+// The prefix of the redis connection for using an embedded database
+const BoltPrefix = "bolt://"
+
+var (
+	stringsBucket = []byte("strings")
+	hashesBucket  = []byte("hashes")
+	zsetsBucket   = []byte("zsets")
+	zindexBucket  = []byte("zindex")
+)
+
+// How often the expired strings are removed from the embedded database
+const BoltSweepInterval = 10 * time.Minute
+
+// boltClient implements RedisClient with an embedded bbolt database,
+// for the small deployments that don't want to run a redis server.
+//
+// The strings are stored with their expiration time (8 bytes, unix
+// nanoseconds, 0 for none) before the value. The fields of the hashes and the
+// members of the sorted sets are stored under "key\x00field". The sorted sets
+// are also indexed by score, under "key\x00score member" in another bucket.
+type boltClient struct {
+	db   *bolt.DB
+	done chan struct{}
+}
+
+// Open (or create) the embedded database at filename
+func NewBoltClient(filename string) (RedisClient, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{stringsBucket, hashesBucket, zsetsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(zindexBucket) == nil {
+			return buildIndex(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := &boltClient{db, make(chan struct{})}
+	go c.sweep()
+	return c, nil
+}
+
+// Index the sorted sets of a database created before the index
+func buildIndex(tx *bolt.Tx) error {
+	index, err := tx.CreateBucketIfNotExists(zindexBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(zsetsBucket).ForEach(func(k, v []byte) error {
+		i := bytes.IndexByte(k, 0)
+		if i < 0 || len(v) != 8 {
+			return nil
+		}
+		return index.Put(indexKey(string(k[:i]), v, string(k[i+1:])), nil)
+	})
+}
+
+// The key in the index for a member of a sorted set. The bytes of the score
+// are changed so the keys are sorted like the scores.
+func indexKey(key string, score []byte, member string) []byte {
+	bits := binary.BigEndian.Uint64(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	k := make([]byte, 0, len(key)+9+len(member))
+	k = append(k, key...)
+	k = append(k, 0)
+	k = binary.BigEndian.AppendUint64(k, bits)
+	return append(k, member...)
+}
+
+// Periodically remove the expired strings, until the client is closed
+func (c *boltClient) sweep() {
+	ticker := time.NewTicker(BoltSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.removeExpired(); err != nil {
+				log.Printf("Error while removing the expired keys: %s\n", err)
+			}
+		}
+	}
+}
+
+// Remove the expired strings
+func (c *boltClient) removeExpired() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stringsBucket)
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if getString(b, string(k)) == nil {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The key in the bucket for a field of a hash or a member of a sorted set
+func subkey(key, field string) []byte {
+	return []byte(key + "\x00" + field)
+}
+
+// Read a string, nil if it doesn't exist or has expired
+func getString(b *bolt.Bucket, key string) []byte {
+	v := b.Get([]byte(key))
+	if len(v) < 8 {
+		return nil
+	}
+	expiresAt := int64(binary.BigEndian.Uint64(v[:8]))
+	if expiresAt != 0 && expiresAt < time.Now().UnixNano() {
+		return nil
+	}
+	return v[8:]
+}
+
+// Write a string, with an expiration if it is not 0
+func putString(b *bolt.Bucket, key string, value []byte, expiration time.Duration) error {
+	v := make([]byte, 8+len(value))
+	if expiration > 0 {
+		binary.BigEndian.PutUint64(v[:8], uint64(time.Now().Add(expiration).UnixNano()))
+	}
+	copy(v[8:], value)
+	return b.Put([]byte(key), v)
+}
+
+// Delete all the fields of a hash, or all the members of a sorted set
+func deletePrefix(b *bolt.Bucket, key string) (deleted bool, err error) {
+	prefix := subkey(key, "")
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err = c.Delete(); err != nil {
+			return
+		}
+		deleted = true
+	}
+	return
+}
+
+// Check if at least one key starts with the prefix for this hash or sorted set
+func hasPrefix(b *bolt.Bucket, key string) bool {
+	prefix := subkey(key, "")
+	k, _ := b.Cursor().Seek(prefix)
+	return k != nil && bytes.HasPrefix(k, prefix)
+}
+
+// Del is the equivalent of the redis DEL command
+func (c *boltClient) Del(keys ...string) *redis.IntCmd {
+	var n int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			deleted := false
+			if b := tx.Bucket(stringsBucket); b.Get([]byte(key)) != nil {
+				if err := b.Delete([]byte(key)); err != nil {
+					return err
+				}
+				deleted = true
+			}
+			for _, name := range [][]byte{hashesBucket, zsetsBucket, zindexBucket} {
+				ok, err := deletePrefix(tx.Bucket(name), key)
+				if err != nil {
+					return err
+				}
+				deleted = deleted || ok
+			}
+			if deleted {
+				n++
+			}
+		}
+		return nil
+	})
+	return redis.NewIntResult(n, err)
+}
+
+// Exists is the equivalent of the redis EXISTS command
+func (c *boltClient) Exists(key string) *redis.BoolCmd {
+	var exists bool
+	err := c.db.View(func(tx *bolt.Tx) error {
+		exists = getString(tx.Bucket(stringsBucket), key) != nil ||
+			hasPrefix(tx.Bucket(hashesBucket), key) ||
+			hasPrefix(tx.Bucket(zsetsBucket), key)
+		return nil
+	})
+	return redis.NewBoolResult(exists, err)
+}
+
+// Get is the equivalent of the redis GET command
+func (c *boltClient) Get(key string) *redis.StringCmd {
+	var val string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := getString(tx.Bucket(stringsBucket), key)
+		if v == nil {
+			return redis.Nil
+		}
+		val = string(v)
+		return nil
+	})
+	return redis.NewStringResult(val, err)
+}
+
+// Set is the equivalent of the redis SET command, with an optional expiration
+func (c *boltClient) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		return putString(tx.Bucket(stringsBucket), key, []byte(fmt.Sprint(value)), expiration)
+	})
+	return redis.NewStatusResult("OK", err)
+}
+
+// TTL is the equivalent of the redis TTL command: -2s if the key doesn't
+// exist, and -1s if it has no expiration
+func (c *boltClient) TTL(key string) *redis.DurationCmd {
+	ttl := -2 * time.Second
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(stringsBucket).Get([]byte(key))
+		if len(v) < 8 {
+			return nil
+		}
+		expiresAt := int64(binary.BigEndian.Uint64(v[:8]))
+		if expiresAt == 0 {
+			ttl = -1 * time.Second
+		} else if remaining := time.Until(time.Unix(0, expiresAt)); remaining > 0 {
+			ttl = remaining.Truncate(time.Second)
+		}
+		return nil
+	})
+	return redis.NewDurationResult(ttl, err)
+}
+
+// IncrBy is the equivalent of the redis INCRBY command
+func (c *boltClient) IncrBy(key string, value int64) *redis.IntCmd {
+	var n int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stringsBucket)
+		if v := getString(b, key); v != nil {
+			var err error
+			if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+				return err
+			}
+		}
+		n += value
+		return putString(b, key, []byte(strconv.FormatInt(n, 10)), 0)
+	})
+	return redis.NewIntResult(n, err)
+}
+
+// HDel is the equivalent of the redis HDEL command
+func (c *boltClient) HDel(key string, fields ...string) *redis.IntCmd {
+	var n int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hashesBucket)
+		for _, field := range fields {
+			if b.Get(subkey(key, field)) == nil {
+				continue
+			}
+			if err := b.Delete(subkey(key, field)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return redis.NewIntResult(n, err)
+}
+
+// HExists is the equivalent of the redis HEXISTS command
+func (c *boltClient) HExists(key, field string) *redis.BoolCmd {
+	var exists bool
+	err := c.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(hashesBucket).Get(subkey(key, field)) != nil
+		return nil
+	})
+	return redis.NewBoolResult(exists, err)
+}
+
+// HGet is the equivalent of the redis HGET command
+func (c *boltClient) HGet(key, field string) *redis.StringCmd {
+	var val string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(hashesBucket).Get(subkey(key, field))
+		if v == nil {
+			return redis.Nil
+		}
+		val = string(v)
+		return nil
+	})
+	return redis.NewStringResult(val, err)
+}
+
+// HSet is the equivalent of the redis HSET command
+func (c *boltClient) HSet(key, field, value string) *redis.BoolCmd {
+	var created bool
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hashesBucket)
+		created = b.Get(subkey(key, field)) == nil
+		return b.Put(subkey(key, field), []byte(value))
+	})
+	return redis.NewBoolResult(created, err)
+}
+
+// ZAdd is the equivalent of the redis ZADD command
+func (c *boltClient) ZAdd(key string, members ...redis.Z) *redis.IntCmd {
+	var n int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b, index := tx.Bucket(zsetsBucket), tx.Bucket(zindexBucket)
+		for _, m := range members {
+			member := fmt.Sprint(m.Member)
+			k := subkey(key, member)
+			if previous := b.Get(k); previous == nil {
+				n++
+			} else if err := index.Delete(indexKey(key, previous, member)); err != nil {
+				return err
+			}
+			score := make([]byte, 8)
+			binary.BigEndian.PutUint64(score, math.Float64bits(m.Score))
+			if err := b.Put(k, score); err != nil {
+				return err
+			}
+			if err := index.Put(indexKey(key, score, member), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return redis.NewIntResult(n, err)
+}
+
+// ZRange is the equivalent of the redis ZRANGE command (members ordered by
+// score). The index is read in order, and only up to stop when it is not
+// counted from the end.
+func (c *boltClient) ZRange(key string, start, stop int64) *redis.StringSliceCmd {
+	var vals []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		prefix := subkey(key, "")
+
+		// Negative indexes are counted from the end, like in redis
+		if start < 0 || stop < 0 {
+			var n int64
+			cur := tx.Bucket(zsetsBucket).Cursor()
+			for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+				n++
+			}
+			if start < 0 {
+				start += n
+			}
+			if stop < 0 {
+				stop += n
+			}
+			if start < 0 {
+				start = 0
+			}
+		}
+
+		var i int64
+		cur := tx.Bucket(zindexBucket).Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && i <= stop; k, _ = cur.Next() {
+			if i >= start {
+				vals = append(vals, string(k[len(prefix)+8:]))
+			}
+			i++
+		}
+		return nil
+	})
+	return redis.NewStringSliceResult(vals, err)
+}
+
+// ZRem is the equivalent of the redis ZREM command
+func (c *boltClient) ZRem(key string, members ...string) *redis.IntCmd {
+	var n int64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b, index := tx.Bucket(zsetsBucket), tx.Bucket(zindexBucket)
+		for _, member := range members {
+			score := b.Get(subkey(key, member))
+			if score == nil {
+				continue
+			}
+			if err := index.Delete(indexKey(key, score, member)); err != nil {
+				return err
+			}
+			if err := b.Delete(subkey(key, member)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return redis.NewIntResult(n, err)
+}
+
+// Match a key with a glob pattern, like redis: * matches any characters
+// (including /), ? matches one character, and \ escapes the next one
+func globMatch(pattern, key string) bool {
+	// The position of the last *, to backtrack when the rest doesn't match
+	star, next := -1, 0
+	p, k := 0, 0
+	for k < len(key) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, k
+			p++
+			continue
+		case p < len(pattern) && pattern[p] == '?':
+			p++
+			k++
+			continue
+		case p+1 < len(pattern) && pattern[p] == '\\' && pattern[p+1] == key[k]:
+			p += 2
+			k++
+			continue
+		case p < len(pattern) && pattern[p] != '\\' && pattern[p] == key[k]:
+			p++
+			k++
+			continue
+		}
+		if star < 0 {
+			return false
+		}
+		next++
+		p, k = star+1, next
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Scan is the equivalent of the redis SCAN command. All the keys matching
+// the pattern are returned at once, with a cursor of 0.
+func (c *boltClient) Scan(cursor int64, match string, count int64) *redis.ScanCmd {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if match == "" || globMatch(match, key) {
+			keys = append(keys, key)
+		}
+	}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stringsBucket)
+		b.ForEach(func(k, v []byte) error {
+			if getString(b, string(k)) != nil {
+				add(string(k))
+			}
+			return nil
+		})
+		for _, name := range [][]byte{hashesBucket, zsetsBucket} {
+			tx.Bucket(name).ForEach(func(k, v []byte) error {
+				if i := bytes.IndexByte(k, 0); i >= 0 {
+					add(string(k[:i]))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return redis.NewScanCmdResult(keys, 0, err)
+}
+
+// Ping is the equivalent of the redis PING command
+func (c *boltClient) Ping() *redis.StatusCmd {
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+	return redis.NewStatusResult("PONG", err)
+}
+
+// Close the embedded database
+func (c *boltClient) Close() error {
+	close(c.done)
+	return c.db.Close()
+}
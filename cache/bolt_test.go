@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	redis "gopkg.in/redis.v3"
+)
+
+func newTestBoltClient(t *testing.T) *boltClient {
+	t.Helper()
+	client, err := NewBoltClient(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client.(*boltClient)
+}
+
+func TestBoltZRange(t *testing.T) {
+	c := newTestBoltClient(t)
+	c.ZAdd("lru", redis.Z{Score: 3, Member: "c"}, redis.Z{Score: -1, Member: "a"}, redis.Z{Score: 2, Member: "b"})
+	c.ZAdd("other", redis.Z{Score: 0, Member: "x"})
+
+	if got := c.ZRange("lru", 0, -1).Val(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("ZRange(0, -1) = %v", got)
+	}
+	if got := c.ZRange("lru", 0, 1).Val(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("ZRange(0, 1) = %v", got)
+	}
+	if got := c.ZRange("lru", -2, -1).Val(); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("ZRange(-2, -1) = %v", got)
+	}
+
+	// A new score moves the member, and ZRem removes it from the index
+	c.ZAdd("lru", redis.Z{Score: 10, Member: "a"})
+	c.ZRem("lru", "b")
+	if got := c.ZRange("lru", 0, -1).Val(); !reflect.DeepEqual(got, []string{"c", "a"}) {
+		t.Errorf("ZRange after ZAdd and ZRem = %v", got)
+	}
+
+	c.Del("lru")
+	if got := c.ZRange("lru", 0, -1).Val(); len(got) != 0 {
+		t.Errorf("ZRange after Del = %v", got)
+	}
+}
+
+func TestBoltRemoveExpired(t *testing.T) {
+	c := newTestBoltClient(t)
+	c.Set("short", "1", time.Nanosecond)
+	c.Set("long", "1", 0)
+	time.Sleep(time.Millisecond)
+
+	if err := c.removeExpired(); err != nil {
+		t.Fatal(err)
+	}
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stringsBucket)
+		if b.Get([]byte("short")) != nil {
+			t.Errorf("the expired key is still there")
+		}
+		if b.Get([]byte("long")) == nil {
+			t.Errorf("the key without expiration is removed")
+		}
+		return nil
+	})
+}
+
+func TestBoltScan(t *testing.T) {
+	c := newTestBoltClient(t)
+	c.HSet("img/http://example.com/a.png", "type", "image/png")
+	c.ZAdd("img/lru", redis.Z{Score: 1, Member: "http://example.com/a.png"})
+	c.Set("img/err/http://example.com/b.png", "404", 0)
+	c.Set("other/http://example.com/c.png", "1", 0)
+
+	_, keys, err := c.Scan(0, "img/*", 100).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	want := []string{"img/err/http://example.com/b.png", "img/http://example.com/a.png", "img/lru"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Scan(img/*) = %v, want %v", keys, want)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"img/*", "img/http://example.com/a.png", true},
+		{"img/*", "img/", true},
+		{"img/*", "other/a", false},
+		{"*.png", "img/http://example.com/a.png", true},
+		{"img/*/a.png", "img/http://example.com/a.png", true},
+		{"img/?", "img/a", true},
+		{"img/?", "img/ab", false},
+		{`img/\*`, "img/*", true},
+		{`img/\*`, "img/a", false},
+	} {
+		if got := globMatch(tt.pattern, tt.key); got != tt.match {
+			t.Errorf("globMatch(%q, %q) = %v", tt.pattern, tt.key, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "gopkg.in/redis.v3"
+)
+
+// RedisClient is the set of redis commands used by the daemon.
+// It is implemented by *redis.Client and *redis.ClusterClient.
+type RedisClient interface {
+	Del(keys ...string) *redis.IntCmd
+	Exists(key string) *redis.BoolCmd
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	IncrBy(key string, value int64) *redis.IntCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	HExists(key, field string) *redis.BoolCmd
+	HGet(key, field string) *redis.StringCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZRange(key string, start, stop int64) *redis.StringSliceCmd
+	ZRem(key string, members ...string) *redis.IntCmd
+	TTL(key string) *redis.DurationCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	Ping() *redis.StatusCmd
+	Close() error
+}
+
+// ErrRedisUser is returned for an URL with a user and a password, as the
+// redis client only authenticates with a password
+var ErrRedisUser = errors.New("Redis users are not supported, give only a password")
+
+// ErrRedisTLS is returned for rediss:// with sentinel or cluster, as their
+// clients can't dial with TLS
+var ErrRedisTLS = errors.New("TLS is not supported with redis sentinel or cluster")
+
+// RedisOptions are the options for the connection to redis
+type RedisOptions struct {
+	// The name of the master monitored by redis sentinel
+	SentinelMaster string
+	// Use a redis cluster
+	Cluster bool
+}
+
+// Create a client for the redis database given as an URL:
+// redis://[:password@]host:port/db, or rediss:// for TLS.
+// The legacy format [password@]host:port/db is also accepted, and
+// bolt:///path/to/file.db replaces redis by an embedded database.
+// With redis sentinel, host:port is a comma-separated list of sentinels,
+// and with redis cluster, it is a comma-separated list of seed nodes.
+func NewRedisClient(conn string, options RedisOptions) (RedisClient, error) {
+	if strings.HasPrefix(conn, BoltPrefix) {
+		filename := strings.TrimPrefix(conn, BoltPrefix)
+		fmt.Printf("Embedded database %s\n", filename)
+		return NewBoltClient(filename)
+	}
+	if !strings.Contains(conn, "://") {
+		conn = "redis://" + conn
+	}
+	u, err := url.Parse(conn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("Invalid scheme for redis: %s", u.Scheme)
+	}
+
+	// In the legacy format, the password is given as the user
+	password, ok := u.User.Password()
+	if !ok {
+		password = u.User.Username()
+	} else if u.User.Username() != "" {
+		return nil, ErrRedisUser
+	}
+	if u.Scheme == "rediss" && (options.Cluster || options.SentinelMaster != "") {
+		return nil, ErrRedisTLS
+	}
+	hosts := strings.Split(u.Host, ",")
+	for i, host := range hosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			hosts[i] = net.JoinHostPort(host, "6379")
+		}
+	}
+	db := 0
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("Invalid redis database: %s", path)
+		}
+	}
+	host := strings.Join(hosts, ",")
+
+	if options.Cluster {
+		fmt.Printf("Connection to cluster %s\n", host)
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    hosts,
+			Password: password,
+		}), nil
+	}
+
+	if options.SentinelMaster != "" {
+		fmt.Printf("Connection to master %s via sentinels %s  %d\n", options.SentinelMaster, host, db)
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    options.SentinelMaster,
+			SentinelAddrs: hosts,
+			Password:      password,
+			DB:            int64(db),
+		}), nil
+	}
+
+	fmt.Printf("Connection %s  %d\n", host, db)
+	opts := &redis.Options{
+		Addr:     host,
+		Password: password,
+		DB:       int64(db),
+	}
+	if u.Scheme == "rediss" {
+		serverName, _, _ := net.SplitHostPort(host)
+		opts.Dialer = func() (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: 5 * time.Second}
+			return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: serverName})
+		}
+	}
+	return redis.NewClient(opts), nil
+}
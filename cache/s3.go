@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The prefix of the cache location for using an S3 bucket
+const S3Prefix = "s3://"
+
+// A bucket on a S3-compatible object storage (AWS, MinIO, etc.),
+// used as a Store to share the cached images between several instances
+type s3Bucket struct {
+	endpoint  string
+	name      string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// Create a bucket from a s3://bucket/prefix location, on the object storage
+// at endpoint. The credentials are taken from the AWS_ACCESS_KEY_ID
+// and AWS_SECRET_ACCESS_KEY environment variables.
+func NewS3Bucket(location, endpoint, region string) (Store, error) {
+	parts := strings.SplitN(strings.TrimPrefix(location, S3Prefix), "/", 2)
+	if parts[0] == "" {
+		return nil, errors.New("Missing bucket name in " + location)
+	}
+	b := &s3Bucket{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		name:      parts[0],
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		b.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	return b, nil
+}
+
+// Send a signed request for the object key
+func (b *s3Bucket) do(method string, key string, body []byte) (res *http.Response, err error) {
+	u := fmt.Sprintf("%s/%s/%s%s", b.endpoint, b.name, b.prefix, key)
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	b.sign(req, body)
+	res, err = b.client.Do(req)
+	if err != nil {
+		return
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: unexpected status code %d", method, key, res.StatusCode)
+	}
+	return
+}
+
+// Sign the request with AWS Signature Version 4
+func (b *s3Bucket) sign(req *http.Request, body []byte) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature))
+}
+
+// Read an object and its last modification time.
+// The object is kept in memory, as the body of the response can't be seeked.
+func (b *s3Bucket) Open(key string) (body io.ReadSeekCloser, modTime time.Time, err error) {
+	res, err := b.do("GET", key, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	modTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	all, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	return NewBytesFile(all), modTime, nil
+}
+
+// Write an object. The body is read in memory, as we need its length and
+// its checksum for the signature.
+func (b *s3Bucket) Put(key string, body io.Reader) error {
+	all, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	res, err := b.do("PUT", key, all)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Remove an object
+func (b *s3Bucket) Delete(key string) error {
+	res, err := b.do("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Give the last modification time of an object
+func (b *s3Bucket) Stat(key string) (modTime time.Time, err error) {
+	res, err := b.do("HEAD", key, nil)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+	return http.ParseTime(res.Header.Get("Last-Modified"))
+}
+
+// The hex-encoded SHA256 of data
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// The HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
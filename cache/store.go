@@ -0,0 +1,175 @@
+// Package cache holds the storage of the daemon: the stores for the bodies of
+// the cached images, and the clients for the metadata kept in redis.
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Store is where the bodies of the cached images are kept
+type Store interface {
+	// Open returns the body for key and its last modification time
+	Open(key string) (body io.ReadSeekCloser, modTime time.Time, err error)
+	// Put saves the body for key
+	Put(key string, body io.Reader) error
+	// Delete removes the body for key
+	Delete(key string) error
+	// Stat returns the last modification time of the body for key
+	Stat(key string) (modTime time.Time, err error)
+}
+
+// Walker is implemented by the stores that can list their files,
+// for the garbage collector
+type Walker interface {
+	// Walk calls fn for each file in the store
+	Walk(fn func(key string, modTime time.Time) error) error
+}
+
+// LocalDeleter is implemented by the stores with a local tier, so the
+// eviction and the garbage collector don't delete the bodies shared with the
+// other instances
+type LocalDeleter interface {
+	// DeleteLocal removes the body for key from the local tier only
+	DeleteLocal(key string) error
+}
+
+// Chtimer is implemented by the stores that can change the mtime of a file,
+// so it is kept when the file is copied from another store
+type Chtimer interface {
+	// Chtimes sets the mtime of the body for key
+	Chtimes(key string, modTime time.Time) error
+}
+
+// Create the store for a location (a directory, file:///path or s3://bucket/prefix).
+// The endpoint and the region are only used for a S3 bucket.
+func NewStore(location, s3Endpoint, s3Region string) (Store, error) {
+	if strings.HasPrefix(location, S3Prefix) {
+		return NewS3Bucket(location, s3Endpoint, s3Region)
+	}
+	return &fileStore{strings.TrimPrefix(location, "file://")}, nil
+}
+
+// A store that keeps the cached images in a local directory
+type fileStore struct {
+	directory string
+}
+
+// The filename on disk for key
+func (f *fileStore) filename(key string) string {
+	return f.directory + "/" + key
+}
+
+// Open the file, and give its mtime
+func (f *fileStore) Open(key string) (body io.ReadSeekCloser, modTime time.Time, err error) {
+	file, err := os.Open(f.filename(key))
+	if err != nil {
+		return
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return
+	}
+	return file, stat.ModTime(), nil
+}
+
+// Write the file, and the directories if they don't exist. The body is
+// written in a temporary file in the same directory, which is renamed once
+// it is complete: a crash can't leave a truncated image in the cache.
+func (f *fileStore) Put(key string, body io.Reader) (err error) {
+	filename := f.filename(key)
+	dirname := path.Dir(filename)
+	err = os.MkdirAll(dirname, 0755)
+	if err != nil {
+		return
+	}
+	file, err := ioutil.TempFile(dirname, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+	_, err = io.Copy(file, body)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// Call fn for each file in the directory, with its key
+func (f *fileStore) Walk(fn func(key string, modTime time.Time) error) error {
+	return filepath.Walk(f.directory, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(f.directory, filename)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(key), info.ModTime())
+	})
+}
+
+// Give the free space on the disk of the directory, in bytes
+func (f *fileStore) FreeSpace() (free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(f.directory, &stat); err != nil {
+		return
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// Remove the file
+func (f *fileStore) Delete(key string) error {
+	return os.Remove(f.filename(key))
+}
+
+// Give the mtime of the file
+func (f *fileStore) Stat(key string) (modTime time.Time, err error) {
+	stat, err := os.Stat(f.filename(key))
+	if err != nil {
+		return
+	}
+	modTime = stat.ModTime()
+	return
+}
+
+// Change the mtime of the file
+func (f *fileStore) Chtimes(key string, modTime time.Time) error {
+	return os.Chtimes(f.filename(key), modTime, modTime)
+}
+
+// bytesFile is a body in memory that can be used like an opened file
+type bytesFile struct {
+	*bytes.Reader
+}
+
+// Create a bytesFile for body
+func NewBytesFile(body []byte) io.ReadSeekCloser {
+	return bytesFile{bytes.NewReader(body)}
+}
+
+// Close does nothing, there is nothing to release
+func (bytesFile) Close() error {
+	return nil
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TierStats counts the reads served by each tier of a TieredStore
+type TierStats struct {
+	LocalHits  int64
+	SharedHits int64
+	Misses     int64
+}
+
+// TieredStore is a store with two tiers: a local one (a directory) for the
+// fast reads, in front of a shared one (a S3 bucket) for all the instances.
+// The reads missing in the local tier fall through the shared one, and
+// populate the local tier in the background. The writes go to the local tier
+// immediately, and to the shared one in the background.
+type TieredStore struct {
+	local   Store
+	shared  Store
+	stats   TierStats
+	enqueue func(func()) bool
+
+	// The keys with a write in the background, so a Delete is not undone
+	// by a write that was queued before it
+	mu     sync.Mutex
+	writes map[string]*pendingWrite
+}
+
+// The writes in the background for a key
+type pendingWrite struct {
+	count     int
+	deletions int
+}
+
+// Create a TieredStore. The writes in the background are given to enqueue,
+// that returns false if the task can't be queued.
+func NewTieredStore(local, shared Store, enqueue func(func()) bool) *TieredStore {
+	return &TieredStore{local: local, shared: shared, enqueue: enqueue, writes: make(map[string]*pendingWrite)}
+}
+
+// Open the body from the local tier, or else from the shared one
+func (t *TieredStore) Open(key string) (body io.ReadSeekCloser, modTime time.Time, err error) {
+	body, modTime, err = t.local.Open(key)
+	if err == nil {
+		atomic.AddInt64(&t.stats.LocalHits, 1)
+		return
+	}
+	body, modTime, err = t.shared.Open(key)
+	if err != nil {
+		atomic.AddInt64(&t.stats.Misses, 1)
+		return
+	}
+	atomic.AddInt64(&t.stats.SharedHits, 1)
+	all, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, modTime, err
+	}
+	// The local tier is only a copy, this write can be dropped
+	t.writeInBackground(t.local, "local", key, all)
+	return NewBytesFile(all), modTime, nil
+}
+
+// Put the body in the local tier, and in the shared one in the background
+func (t *TieredStore) Put(key string, body io.Reader) error {
+	all, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if err = t.local.Put(key, bytes.NewReader(all)); err != nil {
+		return err
+	}
+	// But not this one: it is written now if the queue is full
+	if !t.writeInBackground(t.shared, "shared", key, all) {
+		t.write(t.shared, "shared", key, all, nil, 0)
+	}
+	return nil
+}
+
+// Queue the write of a body in a tier. It returns false if the queue is full.
+func (t *TieredStore) writeInBackground(tier Store, name string, key string, body []byte) bool {
+	t.mu.Lock()
+	w := t.writes[key]
+	if w == nil {
+		w = &pendingWrite{}
+		t.writes[key] = w
+	}
+	w.count++
+	deletions := w.deletions
+	t.mu.Unlock()
+
+	queued := t.enqueue(func() {
+		t.write(tier, name, key, body, w, deletions)
+		t.done(key, w)
+	})
+	if !queued {
+		t.done(key, w)
+	}
+	return queued
+}
+
+// Forget a write in the background, when it is done
+func (t *TieredStore) done(key string, w *pendingWrite) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if w.count--; w.count == 0 {
+		delete(t.writes, key)
+	}
+}
+
+// Check if the key was deleted since the write w was queued
+func (t *TieredStore) deletedSince(w *pendingWrite, deletions int) bool {
+	if w == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return w.deletions != deletions
+}
+
+// Write a body in a tier. For a write in the background, it is skipped, or
+// undone, if the key is deleted in the meantime.
+func (t *TieredStore) write(tier Store, name string, key string, body []byte, w *pendingWrite, deletions int) {
+	if t.deletedSince(w, deletions) {
+		return
+	}
+	if err := tier.Put(key, bytes.NewReader(body)); err != nil {
+		log.Printf("Error while writing %s in the %s tier: %s\n", key, name, err)
+		return
+	}
+	if t.deletedSince(w, deletions) {
+		tier.Delete(key)
+	}
+}
+
+// Delete the body from the two tiers
+func (t *TieredStore) Delete(key string) error {
+	t.mu.Lock()
+	if w := t.writes[key]; w != nil {
+		w.deletions++
+	}
+	t.mu.Unlock()
+
+	lerr := t.local.Delete(key)
+	if err := t.shared.Delete(key); err != nil {
+		return err
+	}
+	return lerr
+}
+
+// Delete the body from the local tier only: the copy in the shared tier is
+// kept for the other instances, and a pending write of it is not cancelled
+func (t *TieredStore) DeleteLocal(key string) error {
+	return t.local.Delete(key)
+}
+
+// Give the mtime of the body, from the local tier or else the shared one
+func (t *TieredStore) Stat(key string) (modTime time.Time, err error) {
+	if modTime, err = t.local.Stat(key); err == nil {
+		return
+	}
+	return t.shared.Stat(key)
+}
+
+// Give the free space of the local tier, if it knows it
+func (t *TieredStore) FreeSpace() (free uint64, err error) {
+	if fs, ok := t.local.(interface{ FreeSpace() (uint64, error) }); ok {
+		return fs.FreeSpace()
+	}
+	return 0, errors.New("Unknown free space for the local tier")
+}
+
+// Call fn for each file of the local tier
+func (t *TieredStore) Walk(fn func(key string, modTime time.Time) error) error {
+	if walker, ok := t.local.(Walker); ok {
+		return walker.Walk(fn)
+	}
+	return nil
+}
+
+// Give the number of reads served by each tier
+func (t *TieredStore) Stats() TierStats {
+	return TierStats{
+		LocalHits:  atomic.LoadInt64(&t.stats.LocalHits),
+		SharedHits: atomic.LoadInt64(&t.stats.SharedHits),
+		Misses:     atomic.LoadInt64(&t.stats.Misses),
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTieredStoreDeleteBeforeWrite(t *testing.T) {
+	var queue []func()
+	enqueue := func(task func()) bool {
+		queue = append(queue, task)
+		return true
+	}
+	local := &fileStore{t.TempDir()}
+	shared := &fileStore{t.TempDir()}
+	tiered := NewTieredStore(local, shared, enqueue)
+
+	if err := tiered.Put("a/b", strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiered.Delete("a/b"); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, task := range queue {
+		task()
+	}
+	if _, err := shared.Stat("a/b"); !os.IsNotExist(err) {
+		t.Errorf("the write in the background undid the delete: %v", err)
+	}
+	if len(tiered.writes) != 0 {
+		t.Errorf("%d pending writes are not forgotten", len(tiered.writes))
+	}
+}
+
+func TestTieredStoreQueueFull(t *testing.T) {
+	local := &fileStore{t.TempDir()}
+	shared := &fileStore{t.TempDir()}
+	tiered := NewTieredStore(local, shared, func(func()) bool { return false })
+
+	if err := tiered.Put("a/b", strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shared.Stat("a/b"); err != nil {
+		t.Errorf("the body is not in the shared tier: %v", err)
+	}
+}
+
+func TestTieredStoreDeleteLocal(t *testing.T) {
+	var queue []func()
+	enqueue := func(task func()) bool {
+		queue = append(queue, task)
+		return true
+	}
+	local := &fileStore{t.TempDir()}
+	shared := &fileStore{t.TempDir()}
+	tiered := NewTieredStore(local, shared, enqueue)
+
+	if err := tiered.Put("a/b", strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiered.DeleteLocal("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range queue {
+		task()
+	}
+	if _, err := local.Stat("a/b"); !os.IsNotExist(err) {
+		t.Errorf("the body is still in the local tier: %v", err)
+	}
+	if _, err := shared.Stat("a/b"); err != nil {
+		t.Errorf("the body is not in the shared tier anymore: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+// The img-LinuxFr.org daemon, a reverse-proxy / cache for the external
+// images of LinuxFr.org, and its maintenance commands
+package main
+
+import "github.com/linuxfrorg/img-LinuxFr.org/httpapi"
+
+func main() {
+	httpapi.Main()
+}
@@ -0,0 +1,116 @@
+package fetcher
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A cached DNS response
+type dnsEntry struct {
+	addrs     []string
+	expiresAt time.Time
+}
+
+// dnsCache resolves the hostnames for the upstream fetches,
+// and keeps the responses in memory for ttl (not at all if it is 0)
+type dnsCache struct {
+	sync.Mutex
+	resolver *net.Resolver
+	ttl      time.Duration
+	entries  map[string]dnsEntry
+}
+
+// Create a DNS cache using the given DNS servers, or the system resolver
+func newDNSCache(servers []string, ttl time.Duration) *dnsCache {
+	resolver := net.DefaultResolver
+	if len(servers) > 0 {
+		var next int
+		var mu sync.Mutex
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				// Round-robin between the configured servers
+				mu.Lock()
+				server := servers[next%len(servers)]
+				next++
+				mu.Unlock()
+				d := net.Dialer{Timeout: 5 * time.Second}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &dnsCache{resolver: resolver, ttl: ttl, entries: make(map[string]dnsEntry)}
+}
+
+// Give the IP addresses for host, from the cache if possible
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if c.ttl > 0 {
+		c.Lock()
+		entry, ok := c.entries[host]
+		c.Unlock()
+		if ok && time.Now().Before(entry.expiresAt) {
+			return entry.addrs, nil
+		}
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ttl > 0 {
+		c.Lock()
+		c.entries[host] = dnsEntry{addrs, time.Now().Add(c.ttl)}
+		c.Unlock()
+	}
+	return addrs, nil
+}
+
+// Remove the expired entries from the cache
+func (c *dnsCache) cleanup() {
+	now := time.Now()
+	c.Lock()
+	for host, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, host)
+		}
+	}
+	c.Unlock()
+}
+
+// Wrap a dial function to resolve the hostnames with the cache,
+// and try the IP addresses one after the other
+func (c *dnsCache) dialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		for _, addr := range addrs {
+			conn, err = dial(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// Periodically remove the expired entries
+func (c *dnsCache) startCleaner() {
+	if c.ttl <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(c.ttl) {
+			c.cleanup()
+		}
+	}()
+}
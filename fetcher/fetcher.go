@@ -0,0 +1,262 @@
+// Package fetcher sends the requests for the images to the distant servers:
+// the hostnames are resolved with a cache, the private addresses are
+// refused, the redirects are checked, and the transient failures are
+// retried.
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Retry twice the fetches that fail for a transient reason
+const Retries = 2
+
+// The delay before the first retry, doubled for each new retry
+const RetryDelay = 500 * time.Millisecond
+
+// The errors of the redirects that are not followed. The HTTP client wraps
+// them in a *url.Error.
+var (
+	ErrTooManyRedirects = errors.New("Too many redirects")
+	ErrInsecureRedirect = errors.New("Redirect from https to http")
+	ErrInvalidRedirect  = errors.New("Invalid redirect")
+)
+
+// Options are the settings of a Fetcher
+type Options struct {
+	// The User-Agent of the requests, and the extra headers sent with them
+	UserAgent string
+	Header    http.Header
+
+	// The maximal number of redirects to follow
+	MaxRedirects int
+
+	// Check the host of each redirect, before following it (nil to accept
+	// all the hosts)
+	CheckHost func(host string) error
+
+	// The HTTP(S) or SOCKS5 proxy ($HTTP_PROXY and $HTTPS_PROXY if empty)
+	Proxy string
+
+	// Allow the private addresses (an image server on the local network,
+	// or a proxy given by $HTTP_PROXY on such an address)
+	AllowPrivate bool
+
+	// The DNS servers to use instead of the system resolver (host:port),
+	// and how long their responses are cached (0 to disable the cache)
+	DNSServers []string
+	DNSTTL     time.Duration
+
+	// The TLS policy for the distant servers
+	TLS TLSOptions
+
+	// The idle connections kept open to each distant server, and for how long
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// Use HTTP/2 with the distant servers that support it
+	HTTP2 bool
+
+	// Log a line about a request, like its retries (nil to not log them)
+	Logf func(ctx context.Context, format string, args ...interface{})
+}
+
+// Timeouts are the limits for fetching an image. They can change from a
+// request to the next one, when the configuration is reloaded.
+type Timeouts struct {
+	Connect time.Duration // for connecting to the distant server
+	TLS     time.Duration // for the TLS handshake
+	Header  time.Duration // for receiving the headers of the response
+	Total   time.Duration // for the whole fetch, including the redirects
+}
+
+// Fetcher sends the requests to the distant servers, over a pool of
+// connections kept open between them
+type Fetcher struct {
+	opts Options
+	dns  *dnsCache
+
+	// The addresses that can be dialed even if they are private: the ones
+	// of the outbound proxy
+	exemptAddresses map[string]bool
+
+	// The transport for the distant servers, without the timeouts
+	base *http.Transport
+
+	// The transport with the timeouts of the last request, reused as long
+	// as they don't change
+	mu        sync.Mutex
+	timeouts  Timeouts
+	transport *http.Transport
+}
+
+// New makes a Fetcher with these options
+func New(opts Options) (*Fetcher, error) {
+	cfg, err := opts.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("Upstream TLS: %w", err)
+	}
+	f := &Fetcher{
+		opts:            opts,
+		dns:             newDNSCache(opts.DNSServers, opts.DNSTTL),
+		exemptAddresses: make(map[string]bool),
+	}
+	f.base = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     cfg,
+		MaxIdleConns:        100 * opts.MaxIdleConnsPerHost,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		// HTTP/2 is disabled by default with a custom dialer and TLS config
+		ForceAttemptHTTP2: opts.HTTP2,
+	}
+	if opts.Proxy != "" {
+		proxyURL, err := ParseProxy(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Proxy: %w", err)
+		}
+		if err = f.exemptProxy(proxyURL); err != nil {
+			return nil, fmt.Errorf("Proxy: %w", err)
+		}
+		f.base.Proxy = http.ProxyURL(proxyURL)
+	}
+	f.dns.startCleaner()
+	return f, nil
+}
+
+// ValidateURL checks that we can fetch an image from this URL
+func ValidateURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Invalid scheme")
+	}
+	if u.Host == "" {
+		return errors.New("Missing host")
+	}
+	return nil
+}
+
+// ParseProxy parses the URL of an outbound proxy: HTTP(S), or SOCKS5 (for
+// Tor, the hostnames are resolved by the proxy)
+func ParseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("Unsupported scheme for the proxy: %s", u.Scheme)
+}
+
+// Decide if a redirect can be followed: the number of redirects is limited,
+// the new URL is validated, and we don't go from https to http
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.opts.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	if err := ValidateURL(req.URL); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRedirect, err)
+	}
+	if f.opts.CheckHost != nil {
+		if err := f.opts.CheckHost(req.URL.Hostname()); err != nil {
+			return err
+		}
+	}
+	if via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return ErrInsecureRedirect
+	}
+	return nil
+}
+
+// PermanentRedirect gives the URL where an image has permanently moved, if
+// the last redirects followed for it were all 301 or 308
+func PermanentRedirect(res *http.Response) (target string, ok bool) {
+	req := res.Request
+	for req.Response != nil {
+		code := req.Response.StatusCode
+		if code != http.StatusMovedPermanently && code != http.StatusPermanentRedirect {
+			return "", false
+		}
+		req = req.Response.Request
+	}
+	return res.Request.URL.String(), req != res.Request
+}
+
+// The transport for these timeouts: the one of the previous request if they
+// have not changed, so its open connections are reused, or else a new one
+// (and the idle connections of the old one are closed)
+func (f *Fetcher) transportFor(t Timeouts) *http.Transport {
+	t.Total = 0
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.transport != nil && f.timeouts == t {
+		return f.transport
+	}
+	if f.transport != nil {
+		f.transport.CloseIdleConnections()
+	}
+	trp := f.base.Clone()
+	dialer := &net.Dialer{Timeout: t.Connect, Control: f.checkDialAddress}
+	trp.DialContext = f.dns.dialer(dialer.DialContext)
+	trp.TLSHandshakeTimeout = t.TLS
+	trp.ResponseHeaderTimeout = t.Header
+	f.timeouts, f.transport = t, trp
+	return trp
+}
+
+// Do sends the request, with the User-Agent and the extra headers, and
+// retries it with a backoff if there is a transient failure (network error
+// or 5xx status code)
+func (f *Fetcher) Do(req *http.Request, t Timeouts) (res *http.Response, err error) {
+	for name, values := range f.opts.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if f.opts.UserAgent != "" {
+		req.Header.Set("User-Agent", f.opts.UserAgent)
+	}
+	client := &http.Client{
+		Transport:     f.transportFor(t),
+		Timeout:       t.Total,
+		CheckRedirect: f.checkRedirect,
+	}
+	for attempt := 0; ; attempt++ {
+		res, err = client.Do(req)
+		if err == nil && res.StatusCode < 500 {
+			return
+		}
+		// The server tells us when to come back, it's not now
+		if err == nil && res.Header.Get("Retry-After") != "" {
+			return
+		}
+		// Don't wait again for a server that has already timed out,
+		// nor for an address that we refuse
+		if ne, ok := err.(net.Error); ok && ne.Timeout() || errors.Is(err, ErrPrivateAddress) {
+			return
+		}
+		if attempt >= Retries {
+			return
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+
+		// Exponential backoff, with some jitter
+		delay := RetryDelay << uint(attempt)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		if f.opts.Logf != nil {
+			f.opts.Logf(req.Context(), "Retry %s in %s\n", req.URL, delay)
+		}
+		time.Sleep(delay)
+	}
+}
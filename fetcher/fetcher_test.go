@@ -0,0 +1,85 @@
+package fetcher
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDoWithOptions(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("User-Agent") != "test/1.0" || r.Header.Get("X-Extra") != "yes" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	f, err := New(Options{
+		UserAgent:    "test/1.0",
+		Header:       http.Header{"X-Extra": {"yes"}},
+		AllowPrivate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	res, err := f.Do(req, Timeouts{Total: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || attempts != 2 {
+		t.Errorf("status = %d after %d attempts, want a retry of the 502", res.StatusCode, attempts)
+	}
+}
+
+func TestTransportForTimeouts(t *testing.T) {
+	f, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trp := f.transportFor(Timeouts{Header: 3 * time.Second, Total: time.Minute})
+	if trp.ResponseHeaderTimeout != 3*time.Second {
+		t.Errorf("ResponseHeaderTimeout = %s, want 3s", trp.ResponseHeaderTimeout)
+	}
+
+	// The transport is kept when only the total timeout changes
+	if f.transportFor(Timeouts{Header: 3 * time.Second}) != trp {
+		t.Errorf("the transport has changed without a new timeout")
+	}
+	if f.transportFor(Timeouts{Header: 5 * time.Second}) == trp {
+		t.Errorf("the transport is kept with a new timeout")
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	f := &Fetcher{opts: Options{MaxRedirects: 1}}
+	via := func(urls ...string) (reqs []*http.Request) {
+		for _, u := range urls {
+			req, _ := http.NewRequest("GET", u, nil)
+			reqs = append(reqs, req)
+		}
+		return
+	}
+	next, _ := http.NewRequest("GET", "http://example.com/b.png", nil)
+	if err := f.checkRedirect(next, via("http://example.com/a.png")); err != nil {
+		t.Errorf("a redirect is refused: %s", err)
+	}
+	if err := f.checkRedirect(next, via("https://example.com/a.png")); err != ErrInsecureRedirect {
+		t.Errorf("a redirect from https to http is accepted: %v", err)
+	}
+	if err := f.checkRedirect(next, via("http://example.com/a.png", "http://example.com/c.png")); err != ErrTooManyRedirects {
+		t.Errorf("too many redirects are accepted: %v", err)
+	}
+	ftp, _ := http.NewRequest("GET", "ftp://example.com/b.png", nil)
+	if err := f.checkRedirect(ftp, via("http://example.com/a.png")); !errors.Is(err, ErrInvalidRedirect) {
+		t.Errorf("a redirect to ftp is accepted: %v", err)
+	}
+}
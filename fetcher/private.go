@@ -0,0 +1,76 @@
+package fetcher
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"syscall"
+)
+
+// The error when an image is on a loopback, private or link-local address
+var ErrPrivateAddress = errors.New("Private address")
+
+// The networks that the upstream fetches can't reach, besides the loopback,
+// private, link-local and multicast addresses
+var reservedNetworks = parseNetworks("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+// Parse a list of CIDRs that are known to be valid
+func parseNetworks(cidrs ...string) (networks []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// Check if an IP address can be reached from the Internet
+func publicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuse to connect to a private address. The dialer calls it with the
+// resolved address of each connection, so it covers the redirects and the
+// moved images, and a hostname can't be resolved to a public address for
+// the checks and to a private one for the connection (DNS rebinding).
+func (f *Fetcher) checkDialAddress(network, address string, c syscall.RawConn) error {
+	if f.opts.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if f.exemptAddresses[host] {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// Allow the connections to the outbound proxy, even on a private address.
+// The proxy is then responsible for refusing the private addresses.
+func (f *Fetcher) exemptProxy(proxy *url.URL) error {
+	addrs, err := net.LookupHost(proxy.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		f.exemptAddresses[addr] = true
+	}
+	return nil
+}
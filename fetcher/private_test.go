@@ -0,0 +1,41 @@
+package fetcher
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckDialAddress(t *testing.T) {
+	f := &Fetcher{}
+	refused := []string{"127.0.0.1:80", "[::1]:443", "10.1.2.3:80", "192.168.0.1:80",
+		"172.16.0.1:80", "169.254.169.254:80", "[fe80::1]:80", "[fd00::1]:80",
+		"0.0.0.0:80", "100.64.0.1:80", "[::ffff:127.0.0.1]:80"}
+	for _, address := range refused {
+		if err := f.checkDialAddress("tcp", address, nil); err != ErrPrivateAddress {
+			t.Errorf("%s is not refused", address)
+		}
+	}
+	for _, address := range []string{"93.184.216.34:80", "[2606:2800:220:1::]:443"} {
+		if err := f.checkDialAddress("tcp", address, nil); err != nil {
+			t.Errorf("%s is refused: %s", address, err)
+		}
+	}
+}
+
+func TestPrivateAddressRefused(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer local.Close()
+
+	f, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", local.URL, nil)
+	if _, err = f.Do(req, Timeouts{}); !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("err = %v, want ErrPrivateAddress", err)
+	}
+}
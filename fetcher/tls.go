@@ -0,0 +1,85 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSOptions is the TLS policy for the distant servers
+type TLSOptions struct {
+	// Accept any certificate (for the images of self-hosted blogs with
+	// self-signed certificates), unless CAFile is given
+	InsecureSkipVerify bool
+
+	// A file with extra certificate authorities (PEM) for the distant
+	// servers using an internal CA. The certificates are then verified.
+	CAFile string
+
+	// The minimal version of TLS (1.0, 1.1, 1.2 or 1.3, 1.2 if empty)
+	MinVersion string
+
+	// The cipher suites allowed for TLS 1.0 to 1.2, comma-separated (the
+	// defaults of Go if empty)
+	Ciphers string
+}
+
+// The versions of TLS, by name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Verified tells if the certificates of the distant servers are verified
+func (o TLSOptions) Verified() bool {
+	return !o.InsecureSkipVerify || o.CAFile != ""
+}
+
+// Config gives the TLS configuration for fetching the images on the
+// distant servers
+func (o TLSOptions) Config() (cfg *tls.Config, err error) {
+	cfg = &tls.Config{InsecureSkipVerify: !o.Verified()}
+	minVersion := o.MinVersion
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, errors.New("Unknown TLS version: " + minVersion)
+	}
+	cfg.MinVersion = version
+
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate found in " + o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.Ciphers != "" {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(o.Ciphers, ",") {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, errors.New("Unknown or insecure cipher suite: " + name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	return
+}
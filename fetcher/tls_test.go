@@ -0,0 +1,27 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	cfg, err := TLSOptions{MinVersion: "1.3"}.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.InsecureSkipVerify || cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("InsecureSkipVerify = %v and MinVersion = %x", cfg.InsecureSkipVerify, cfg.MinVersion)
+	}
+
+	if cfg, _ = (TLSOptions{InsecureSkipVerify: true}).Config(); !cfg.InsecureSkipVerify {
+		t.Errorf("the certificates are verified with InsecureSkipVerify")
+	}
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x, want TLS 1.2 by default", cfg.MinVersion)
+	}
+
+	if _, err = (TLSOptions{MinVersion: "2.0"}).Config(); err == nil {
+		t.Errorf("an unknown version of TLS is accepted")
+	}
+}
@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The format of the access log: combined, json, or empty for none
+var accessLogFormat string
+
+// The key for the access log entry in the context of a request
+const accessEntryKey contextKey = 1
+
+// What we log for a request
+type accessEntry struct {
+	Time     string  `json:"time"`
+	ClientIP string  `json:"client_ip"`
+	Method   string  `json:"method"`
+	Path     string  `json:"path"`
+	Proto    string  `json:"proto"`
+	Status   int     `json:"status"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"`
+	Cache    string  `json:"cache,omitempty"`
+	Referer  string  `json:"referer,omitempty"`
+	Agent    string  `json:"user_agent,omitempty"`
+	ID       string  `json:"request_id,omitempty"`
+}
+
+// statusWriter remembers the status code and the size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader keeps the status code
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes of the body
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile of the cached files when it is available
+func (w *statusWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.bytes += n
+	return
+}
+
+// Unwrap gives the original ResponseWriter (for http.ResponseController)
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Remember if the image was in the cache (hit, miss, stale, hot) for the access log
+func setCacheStatus(ctx context.Context, status string) {
+	if entry, ok := ctx.Value(accessEntryKey).(*accessEntry); ok {
+		entry.Cache = status
+	}
+}
+
+// Log each request, in the combined log format (with the duration and
+// the cache status at the end) or in JSON
+func withAccessLog(handler http.Handler) http.Handler {
+	if accessLogFormat == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{
+			ClientIP: clientIP(r),
+			Method:   r.Method,
+			Path:     r.URL.RequestURI(),
+			Proto:    r.Proto,
+			Referer:  r.Referer(),
+			Agent:    r.UserAgent(),
+			ID:       requestID(r.Context()),
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), accessEntryKey, entry)
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+
+		entry.Status = sw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Bytes = sw.bytes
+		entry.Duration = time.Since(start).Seconds()
+		writeAccessLog(entry, start)
+	})
+}
+
+// Write an entry of the access log on the standard output
+func writeAccessLog(entry *accessEntry, start time.Time) {
+	if accessLogFormat == "json" {
+		entry.Time = start.Format(time.RFC3339Nano)
+		line, err := json.Marshal(entry)
+		if err == nil {
+			os.Stdout.Write(append(line, '\n'))
+		}
+		return
+	}
+	cache := entry.Cache
+	if cache == "" {
+		cache = "-"
+	}
+	fmt.Fprintf(os.Stdout, "%s - - [%s] %q %d %d %q %q %.3f %s\n",
+		entry.ClientIP, start.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method+" "+entry.Path+" "+entry.Proto, entry.Status, entry.Bytes,
+		entry.Referer, entry.Agent, entry.Duration, cache)
+}
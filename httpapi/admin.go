@@ -0,0 +1,244 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+// The token needed to use the admin endpoints (they are disabled without it)
+var adminToken string
+
+// The user:password for using the admin endpoints with basic auth
+var adminBasicAuth string
+
+// The networks allowed to use the admin endpoints (comma-separated CIDRs)
+var adminAllow string
+
+// The parsed networks of adminAllow
+var adminNetworks []*net.IPNet
+
+// Parse the networks allowed to use the admin endpoints
+func parseAdminAllow() error {
+	if adminAllow == "" {
+		return nil
+	}
+	for _, cidr := range strings.Split(adminAllow, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return err
+		}
+		adminNetworks = append(adminNetworks, network)
+	}
+	return nil
+}
+
+// Check if the client is in one of the allowed networks
+func allowedNetwork(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, network := range adminNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the request has the right credentials to use the admin endpoints:
+// the bearer token or the basic auth, from an allowed network if the
+// networks are restricted. Without credentials, the allowed networks are
+// enough, and the admin endpoints are disabled if there are none.
+func authorized(r *http.Request) bool {
+	if len(adminNetworks) > 0 && !allowedNetwork(r) {
+		return false
+	}
+	if adminToken == "" && adminBasicAuth == "" {
+		return len(adminNetworks) > 0
+	}
+	if adminToken != "" {
+		auth := []byte(r.Header.Get("Authorization"))
+		expected := []byte("Bearer " + adminToken)
+		if subtle.ConstantTimeCompare(auth, expected) == 1 {
+			return true
+		}
+	}
+	if adminBasicAuth != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			given := []byte(user + ":" + password)
+			if subtle.ConstantTimeCompare(given, []byte(adminBasicAuth)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Only call the handler for the authorized requests
+func adminOnly(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			if adminBasicAuth != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="img-LinuxFr.org"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// Remove everything we know about uri: the cached file and the redis keys
+func (srv *Server) purgeFromCache(uri string) {
+	srv.deleteFromCache(uri)
+	srv.redis.Del(srv.keyPrefix+uri, srv.keyPrefix+"err/"+uri)
+}
+
+// Receive an HTTP request to remove an image from the cache
+func (srv *Server) Purge(w http.ResponseWriter, r *http.Request) {
+	uri, err := srv.decodeURL(r)
+	if err != nil {
+		http.Error(w, "Invalid parameters", 400)
+		return
+	}
+	logf(r.Context(), "Purge %s\n", uri)
+	srv.purgeFromCache(uri)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Read the URL of the image from the url form value
+func (srv *Server) formURL(w http.ResponseWriter, r *http.Request) (uri string, ok bool) {
+	uri = r.FormValue("url")
+	if uri == "" {
+		http.Error(w, "Missing url parameter", 400)
+		return
+	}
+	uri, err := srv.parseImageURL(uri)
+	if err != nil {
+		http.Error(w, "Invalid url parameter", 400)
+		return
+	}
+	ok = true
+	return
+}
+
+// Receive an HTTP request to block an image: it won't be served anymore
+func (srv *Server) Block(w http.ResponseWriter, r *http.Request) {
+	uri, ok := srv.formURL(w, r)
+	if !ok {
+		return
+	}
+	logf(r.Context(), "Block %s\n", uri)
+	srv.redis.HSet(srv.keyPrefix+uri, "status", "Blocked")
+	srv.deleteFromCache(uri)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Receive an HTTP request to unblock an image
+func (srv *Server) Unblock(w http.ResponseWriter, r *http.Request) {
+	uri, ok := srv.formURL(w, r)
+	if !ok {
+		return
+	}
+	logf(r.Context(), "Unblock %s\n", uri)
+	srv.redis.HDel(srv.keyPrefix+uri, "status")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Receive an HTTP request for the statistics of the background tasks and
+// of the tiers of the cache
+func (srv *Server) Stats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]int64{
+		"queue_depth":      int64(queueDepth()),
+		"queue_capacity":   int64(cap(backgroundTasks)),
+		"queue_dropped":    atomic.LoadInt64(&droppedTasks),
+		"tier_memory_hits": atomic.LoadInt64(&hotHits),
+	}
+	if tiered, ok := srv.store.(*cache.TieredStore); ok {
+		tiers := tiered.Stats()
+		stats["tier_local_hits"] = tiers.LocalHits
+		stats["tier_shared_hits"] = tiers.SharedHits
+		stats["tier_misses"] = tiers.Misses
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// The metadata of an image, for the main site and the moderators
+type imageMeta struct {
+	URL          string `json:"url"`
+	ContentType  string `json:"content_type,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+	CreatedAt    string `json:"created_at,omitempty"`
+	FetchedAt    string `json:"fetched_at,omitempty"`
+	Status       string `json:"status,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	Gone         bool   `json:"gone"`
+	FinalURL     string `json:"final_url,omitempty"`
+	MovedTo      string `json:"moved_to,omitempty"`
+	OriginETag   string `json:"origin_etag,omitempty"`
+	Color        string `json:"dominant_color,omitempty"`
+	NSFW         string `json:"nsfw,omitempty"`
+	NeedsRefresh bool   `json:"needs_refresh"`
+}
+
+// Receive an HTTP request for the metadata of an image, and respond with JSON
+func (srv *Server) Meta(w http.ResponseWriter, r *http.Request) {
+	uri, err := srv.decodeURL(r)
+	if err != nil {
+		http.Error(w, "Invalid parameters", 400)
+		return
+	}
+	hexists := srv.redis.HExists(srv.keyPrefix+uri, "created_at")
+	if hexists.Err() != nil {
+		http.Error(w, "Redis is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !hexists.Val() {
+		http.NotFound(w, r)
+		return
+	}
+
+	meta := imageMeta{URL: uri, Size: srv.cachedSize(uri)}
+	fields := map[string]*string{
+		"type":       &meta.ContentType,
+		"checksum":   &meta.Checksum,
+		"created_at": &meta.CreatedAt,
+		"status":     &meta.Status,
+		"final_url":  &meta.FinalURL,
+		"moved_to":   &meta.MovedTo,
+		"etag":       &meta.OriginETag,
+		"color":      &meta.Color,
+		"nsfw":       &meta.NSFW,
+	}
+	for field, value := range fields {
+		if hget := srv.redis.HGet(srv.keyPrefix+uri, field); hget.Err() == nil {
+			*value = hget.Val()
+		}
+	}
+	if get := srv.redis.Get(srv.keyPrefix + "err/" + uri); get.Err() == nil {
+		meta.LastError = get.Val()
+		meta.Gone = goneError(parseCachedError(meta.LastError))
+	}
+	if meta.ContentType != "" {
+		if mtime, err := srv.store.Stat(srv.cacheKey(uri)); err == nil {
+			meta.FetchedAt = mtime.UTC().Format(time.RFC3339)
+		}
+	}
+	exists := srv.redis.Exists(srv.keyPrefix + "updated/" + uri)
+	meta.NeedsRefresh = exists.Err() == nil && !exists.Val()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
@@ -0,0 +1,44 @@
+package httpapi
+
+import (
+	_ "image/gif"
+	"io"
+)
+
+// Decode an image when it is cached, to compute its placeholders and its
+// dominant color. The formats that Go can't decode (SVG, WebP, etc.) are
+// skipped, and flagged as undecodable so they are not decoded again.
+func (srv *Server) analyzeImage(uri string, body io.ReadSeeker) {
+	if !placeholders && !dominantColors {
+		return
+	}
+	img, _, err := decodeImage(body)
+	if err != nil {
+		srv.redis.HSet(srv.keyPrefix+uri, "undecodable", "1")
+		return
+	}
+	srv.redis.HDel(srv.keyPrefix+uri, "undecodable")
+	if placeholders {
+		srv.savePlaceholders(uri, img)
+	}
+	if dominantColors {
+		srv.saveDominantColor(uri, img)
+	}
+}
+
+// Analyze an image that was cached before the analysis was enabled
+func (srv *Server) analyzeCachedImage(uri string) {
+	hexists := srv.redis.HExists(srv.keyPrefix+uri, "type")
+	if hexists.Err() != nil || !hexists.Val() {
+		return
+	}
+	if undecodable := srv.redis.HExists(srv.keyPrefix+uri, "undecodable"); undecodable.Val() {
+		return
+	}
+	body, _, err := srv.store.Open(srv.cacheKey(uri))
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	srv.analyzeImage(uri, body)
+}
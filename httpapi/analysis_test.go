@@ -0,0 +1,20 @@
+package httpapi
+
+import "testing"
+
+func TestUndecodableImageIsNotDecodedAgain(t *testing.T) {
+	srv := setupCache(t)
+	defer func() { placeholders = false }()
+	placeholders = true
+
+	uri := "http://a.example/1.png"
+	saveTestImage(t, srv, uri, "not a PNG image")
+	if hexists := srv.redis.HExists(srv.keyPrefix+uri, "undecodable"); !hexists.Val() {
+		t.Fatalf("the decode failure is not remembered")
+	}
+
+	srv.evictFromCache(uri)
+	if hexists := srv.redis.HExists(srv.keyPrefix+uri, "undecodable"); hexists.Val() {
+		t.Errorf("the decode failure is kept after the eviction")
+	}
+}
@@ -0,0 +1,55 @@
+package httpapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+// The default avatar, served when the avatar of a user is missing or broken
+// (nil to redirect to DefaultAvatarUrl)
+var defaultAvatar *localImage
+
+// An image loaded in memory from a local file
+type localImage struct {
+	contentType string
+	body        []byte
+	modTime     time.Time
+}
+
+// Load an image from a local file
+func loadLocalImage(filename string) (*localImage, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	contentType, err := sniffContentType(body, "image/svg+xml")
+	if err != nil {
+		return nil, err
+	}
+	return &localImage{contentType, body, stat.ModTime()}, nil
+}
+
+// Respond with the local image
+func (img *localImage) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", img.contentType)
+	w.Header().Set("Cache-Control", publicCacheControl(currentSettings().maxAge))
+	http.ServeContent(w, r, "", img.modTime, cache.NewBytesFile(img.body))
+}
+
+// Respond with the default avatar, or redirect to it
+func defaultAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	if defaultAvatar != nil {
+		defaultAvatar.serve(w, r)
+		return
+	}
+	w.Header().Set("Location", DefaultAvatarUrl)
+	w.WriteHeader(http.StatusFound)
+}
@@ -0,0 +1,74 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// How long we wait before fetching again from a host that responded 429
+// without a Retry-After header
+const DefaultHostBackoff = 1 * time.Minute
+
+// The maximal backoff asked by a host with Retry-After
+const MaxHostBackoff = 1 * time.Hour
+
+// The error when we don't fetch an image as its host asked us to slow down
+var ErrHostBackoff = errors.New("The host asked us to slow down")
+
+// Parse a Retry-After header: a number of seconds, or an HTTP date
+func parseRetryAfter(value string) (delay time.Duration, ok bool) {
+	if value == "" {
+		return
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, seconds > 0
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+		return delay, delay > 0
+	}
+	return
+}
+
+// Record the backoff asked by a host with a 429 or a 503 response, so the
+// other fetches on this host (from all the instances) are suppressed until
+// it expires. The host is the one that responded, after the redirections.
+func (srv *Server) recordBackoff(res *http.Response) {
+	if res.Request == nil {
+		return
+	}
+	host := res.Request.URL.Host
+	delay, ok := parseRetryAfter(res.Header.Get("Retry-After"))
+	if !ok {
+		if res.StatusCode != http.StatusTooManyRequests {
+			return
+		}
+		delay = DefaultHostBackoff
+	}
+	if delay > MaxHostBackoff {
+		delay = MaxHostBackoff
+	}
+	srv.redis.Set(srv.keyPrefix+"backoff/"+host, strconv.Itoa(res.StatusCode), delay)
+}
+
+// Check if we must wait before fetching from host
+func (srv *Server) backedOff(host string) bool {
+	exists := srv.redis.Exists(srv.keyPrefix + "backoff/" + host)
+	return exists.Err() == nil && exists.Val()
+}
+
+// The remaining time before we can fetch again from the host of uri
+func (srv *Server) backoffRemaining(uri string) time.Duration {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return DefaultHostBackoff
+	}
+	ttl := srv.redis.TTL(srv.keyPrefix + "backoff/" + u.Host)
+	if ttl.Err() != nil || ttl.Val() <= 0 {
+		return DefaultHostBackoff
+	}
+	return ttl.Val()
+}
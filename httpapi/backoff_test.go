@@ -0,0 +1,24 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRecordBackoffFinalHost(t *testing.T) {
+	srv := setupCache(t)
+	final, _ := url.Parse("http://cdn.example/a.png")
+	res := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": {"120"}},
+		Request:    &http.Request{URL: final},
+	}
+	srv.recordBackoff(res)
+	if !srv.backedOff("cdn.example") {
+		t.Errorf("the host that responded 429 is not backed off")
+	}
+	if srv.backedOff("blog.example") {
+		t.Errorf("the host that redirected is backed off")
+	}
+}
@@ -0,0 +1,129 @@
+package httpapi
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The error when the content of an image has been banned by the moderators
+var ErrBannedContent = errors.New("Banned content")
+
+// Check if one of the checksums (SHA1 or SHA256) of an image has been banned
+func (srv *Server) bannedChecksum(checksums ...string) bool {
+	for _, checksum := range checksums {
+		exists := srv.redis.Exists(srv.keyPrefix + "banned/" + checksum)
+		if exists.Err() == nil && exists.Val() {
+			return true
+		}
+	}
+	return false
+}
+
+// The checksums (SHA1 and SHA256) of a body, as hexadecimal strings
+func bodyChecksums(body []byte) (sum1, sum256 string) {
+	return fmt.Sprintf("%x", sha1.Sum(body)), fmt.Sprintf("%x", sha256.Sum256(body))
+}
+
+// The fields of the hash of an image with the checksums that can be banned:
+// the ones of the cached body, and of the body sent by its server when it
+// has been converted or manipulated
+var bannableFields = []string{"checksum", "sha256", "source_sha1", "source_sha256"}
+
+// Remember the checksums of the body sent by the server for uri, when it is
+// not the cached one ("" if it is)
+func (srv *Server) saveSourceChecksums(uri, sum1, sum256 string) {
+	if sum1 == "" {
+		srv.redis.HDel(srv.keyPrefix+uri, "source_sha1", "source_sha256")
+		return
+	}
+	srv.redis.HSet(srv.keyPrefix+uri, "source_sha1", sum1)
+	srv.redis.HSet(srv.keyPrefix+uri, "source_sha256", sum256)
+}
+
+// Block the URL of an image with a banned content, and remove it from the cache
+func (srv *Server) blockBannedImage(uri string) {
+	srv.redis.HSet(srv.keyPrefix+uri, "status", "Blocked")
+	srv.deleteFromCache(uri)
+}
+
+// Check if one of the checksums of the image cached for uri has been banned
+func (srv *Server) bannedImage(uri string) bool {
+	var checksums []string
+	for _, field := range bannableFields {
+		if hget := srv.redis.HGet(srv.keyPrefix+uri, field); hget.Err() == nil && hget.Val() != "" {
+			checksums = append(checksums, hget.Val())
+		}
+	}
+	return srv.bannedChecksum(checksums...)
+}
+
+// Block the cached images that have a banned checksum. With a redis cluster,
+// they can't be listed: they are blocked when they are served instead.
+func (srv *Server) purgeBannedChecksum(checksum string) {
+	uris, err := srv.cachedURLs()
+	if err == ErrClusterScan {
+		log.Printf("The images with the checksum %s will be blocked when they are served\n", checksum)
+		return
+	}
+	if err != nil {
+		log.Printf("Error while scanning redis for %s: %s\n", checksum, err)
+		return
+	}
+	for _, uri := range uris {
+		for _, field := range bannableFields {
+			if hget := srv.redis.HGet(srv.keyPrefix+uri, field); hget.Err() == nil && hget.Val() == checksum {
+				log.Printf("Block %s, its content is banned\n", uri)
+				srv.blockBannedImage(uri)
+				break
+			}
+		}
+	}
+}
+
+// Read a SHA1 or SHA256 checksum from the checksum form value. It is
+// lowercased, as the checksums are saved in hex with lowercase letters.
+func formChecksum(w http.ResponseWriter, r *http.Request) (checksum string, ok bool) {
+	checksum = strings.ToLower(strings.TrimSpace(r.FormValue("checksum")))
+	if _, err := hex.DecodeString(checksum); err != nil || (len(checksum) != 40 && len(checksum) != 64) {
+		http.Error(w, "Invalid checksum parameter", 400)
+		return
+	}
+	ok = true
+	return
+}
+
+// Receive an HTTP request to ban the images with a checksum, whatever their
+// URL. The images already cached are blocked in the background.
+func (srv *Server) BlockChecksum(w http.ResponseWriter, r *http.Request) {
+	checksum, ok := formChecksum(w, r)
+	if !ok {
+		return
+	}
+	logf(r.Context(), "Ban %s\n", checksum)
+	if err := srv.redis.Set(srv.keyPrefix+"banned/"+checksum, "1", 0).Err(); err != nil {
+		http.Error(w, "Redis is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	enqueue(func() {
+		srv.purgeBannedChecksum(checksum)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Receive an HTTP request to unban a checksum. The URLs blocked for it stay
+// blocked, they can be unblocked one by one.
+func (srv *Server) UnblockChecksum(w http.ResponseWriter, r *http.Request) {
+	checksum, ok := formChecksum(w, r)
+	if !ok {
+		return
+	}
+	logf(r.Context(), "Unban %s\n", checksum)
+	srv.redis.Del(srv.keyPrefix + "banned/" + checksum)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,65 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+)
+
+func TestBannedSourceChecksum(t *testing.T) {
+	srv := setupCache(t)
+	var body bytes.Buffer
+	png.Encode(&body, image.NewGray(image.Rect(0, 0, 4, 4)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body.Bytes())
+	}))
+	defer server.Close()
+	srv.fetcher, _ = fetcher.New(fetcher.Options{AllowPrivate: true})
+
+	// The cached body is not the one sent by the server
+	behaviour := Behaviour{MaxSize: MaxSize, Manipulate: func(uri string, body []byte) []byte {
+		return append(append([]byte(nil), body...), 0)
+	}}
+	uri := server.URL + "/banned.png"
+	srv.redis.HSet(srv.keyPrefix+uri, "created_at", "1")
+	sum1, _ := bodyChecksums(body.Bytes())
+	srv.redis.Set(srv.keyPrefix+"banned/"+sum1, "1", 0)
+
+	if err := srv.fetchImageFromServer(context.Background(), uri, behaviour); err != ErrBannedContent {
+		t.Fatalf("err = %v, want ErrBannedContent", err)
+	}
+	if err := srv.urlStatus(uri); err != ErrBlocked {
+		t.Errorf("the image is not blocked: %v", err)
+	}
+}
+
+func TestFormChecksum(t *testing.T) {
+	sha1 := "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{sha1, true},
+		{strings.ToUpper(sha1), true},
+		{" " + sha1 + "\n", true},
+		{sha1[:39], false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/admin/block-checksum", strings.NewReader(url.Values{"checksum": {tt.value}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		checksum, ok := formChecksum(httptest.NewRecorder(), r)
+		if ok != tt.ok || (ok && checksum != sha1) {
+			t.Errorf("formChecksum(%q) = %q, %v", tt.value, checksum, ok)
+		}
+	}
+}
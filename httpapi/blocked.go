@@ -0,0 +1,37 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+)
+
+// The status code of the responses for the blocked images
+var blockedStatus int
+
+// The image served for the blocked images (nil for none)
+var blockedImage *localImage
+
+// The error when the URL of an image has been blocked by the moderators
+var ErrBlocked = errors.New("Blocked")
+
+// Check if an error means that the image has been blocked: its URL, its
+// domain or its content
+func isBlocked(err error) bool {
+	return err == ErrBlocked || err == ErrBlockedDomain || err == ErrBannedContent
+}
+
+// Respond for a blocked image, so the readers can tell moderation from
+// breakage: with blockedStatus (451 by default), and the "content removed"
+// image if there is one
+func blockedHandler(w http.ResponseWriter, r *http.Request) {
+	if blockedImage == nil {
+		http.Error(w, http.StatusText(blockedStatus), blockedStatus)
+		return
+	}
+	w.Header().Set("Content-Type", blockedImage.contentType)
+	w.Header().Set("Cache-Control", publicCacheControl(currentSettings().maxAge))
+	w.WriteHeader(blockedStatus)
+	if r.Method != "HEAD" {
+		w.Write(blockedImage.body)
+	}
+}
@@ -0,0 +1,70 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// The size of the buffers for copying the images
+const CopyBufferLen = 64 << 10
+
+// The buffers for the whole bodies larger than this size are not kept in
+// the pool, to not hold this memory forever after a single large image
+const MaxPooledBodyLen = 8 << 20
+
+// The readers for sniffing the headers of the fetched images
+var headerReaders = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, HeaderLen) },
+}
+
+// The buffers for copying the images
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, CopyBufferLen)
+		return &buf
+	},
+}
+
+// The buffers for the whole bodies of the images that are converted or
+// manipulated
+var bodyBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Take a reader from the pool for the headers of body
+func getHeaderReader(body io.Reader) *bufio.Reader {
+	br := headerReaders.Get().(*bufio.Reader)
+	br.Reset(body)
+	return br
+}
+
+// Give back a reader taken by getHeaderReader
+func putHeaderReader(br *bufio.Reader) {
+	br.Reset(nil)
+	headerReaders.Put(br)
+}
+
+// Take an empty buffer from the pool for a whole body
+func getBodyBuffer() *bytes.Buffer {
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Give back a buffer taken by getBodyBuffer. Its bytes must not be used
+// anymore.
+func putBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= MaxPooledBodyLen {
+		bodyBuffers.Put(buf)
+	}
+}
+
+// Copy from src to dst, like io.Copy, but with a buffer from the pool
+func copyWithPool(dst io.Writer, src io.Reader) (written int64, err error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hide the ReadFrom of dst (os.File), that would allocate its own buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
@@ -0,0 +1,68 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// A fake image body of 512KB
+var benchmarkBody = bytes.Repeat([]byte("0123456789abcdef"), 32<<10)
+
+// A reader that hides the WriteTo of bytes.Reader, as a response body would
+func benchmarkReader() io.Reader {
+	return struct{ io.Reader }{bytes.NewReader(benchmarkBody)}
+}
+
+func BenchmarkHeaderReaderPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		br := getHeaderReader(benchmarkReader())
+		br.Peek(HeaderLen)
+		putHeaderReader(br)
+	}
+}
+
+func BenchmarkHeaderReaderUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		br := bufio.NewReaderSize(benchmarkReader(), HeaderLen)
+		br.Peek(HeaderLen)
+	}
+}
+
+func BenchmarkCopyPooled(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkBody)))
+	for i := 0; i < b.N; i++ {
+		copyWithPool(struct{ io.Writer }{ioutil.Discard}, benchmarkReader())
+	}
+}
+
+func BenchmarkCopyUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkBody)))
+	for i := 0; i < b.N; i++ {
+		io.Copy(struct{ io.Writer }{ioutil.Discard}, benchmarkReader())
+	}
+}
+
+func BenchmarkBodyBufferPooled(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkBody)))
+	for i := 0; i < b.N; i++ {
+		buf := getBodyBuffer()
+		buf.ReadFrom(benchmarkReader())
+		putBodyBuffer(buf)
+	}
+}
+
+func BenchmarkBodyBufferUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkBody)))
+	for i := 0; i < b.N; i++ {
+		ioutil.ReadAll(benchmarkReader())
+	}
+}
@@ -0,0 +1,60 @@
+package httpapi
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Check the configuration and the dependencies, and exit, instead of
+// starting the daemon
+var checkOnly bool
+
+// Check that the certificate and its key can be loaded, and that the
+// certificate has not expired
+func checkTLS(certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(reloader.cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("The certificate has expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Run the checks of the dependencies, print their results with a hint for
+// the failing ones, and give the exit code. The options have already been
+// parsed and validated when we get there.
+func (srv *Server) runChecks(certFile, keyFile string) int {
+	checks := []struct {
+		name string
+		err  error
+		hint string
+	}{
+		{"redis", srv.checkRedis(), "check that redis is running and reachable with -r"},
+		{"store", srv.checkStore(), "check that the directory given by -d exists and is writable by this user"},
+		{"tls", checkTLS(certFile, keyFile), "check the files given by -tls-cert and -tls-key"},
+	}
+	code := 0
+	for _, check := range checks {
+		if check.err == nil {
+			fmt.Printf("%s: ok\n", check.name)
+			continue
+		}
+		fmt.Printf("%s: %s (%s)\n", check.name, check.err, check.hint)
+		code = 1
+	}
+	return code
+}
@@ -0,0 +1,102 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// The key of the context for the end of the request of a client
+type clientDoneKeyType struct{}
+
+// The key of the context for the end of the request of a client
+var clientDoneKey = clientDoneKeyType{}
+
+// A fetch from the distant server, shared by the requests and the background
+// tasks waiting for the same image. It is cancelled when all of them are gone.
+type sharedFetch struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// The fetches with clients or tasks waiting for them, by URL
+var sharedFetches = make(map[string]*sharedFetch)
+
+// The lock for sharedFetches
+var sharedFetchesLock sync.Mutex
+
+// Add the end of the request of the client to the context of a fetch, so the
+// fetch can be cancelled when the client goes away
+func withClient(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, clientDoneKey, r.Context().Done())
+}
+
+// Remove the client from the context of a background task
+func withoutClient(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientDoneKey, nil)
+}
+
+// The channel closed when the client has gone, nil for the background tasks
+func clientDone(ctx context.Context) <-chan struct{} {
+	done, _ := ctx.Value(clientDoneKey).(<-chan struct{})
+	return done
+}
+
+// Fetch an image for a client or a background task. The fetch is shared with
+// the others waiting for the same image, and cancelled if all of them have
+// gone before its end. A background task never goes away, so the fetch it
+// waits for is never cancelled.
+func fetchShared(ctx context.Context, uri string, fetch func(ctx context.Context) error) error {
+	done := clientDone(ctx)
+	for {
+		f := joinFetch(ctx, uri)
+		ch := fetchGroup.DoChan(uri, func() (interface{}, error) {
+			return nil, fetch(f.ctx)
+		})
+		select {
+		case res := <-ch:
+			// We have joined a fetch cancelled by its clients just before
+			// its end: we start a new one
+			retry := errors.Is(res.Err, context.Canceled) && f.ctx.Err() == nil
+			leaveFetch(uri, f)
+			if retry {
+				continue
+			}
+			return res.Err
+		case <-done:
+			leaveFetch(uri, f)
+			return context.Canceled
+		}
+	}
+}
+
+// Register a client or a task waiting for the fetch of uri
+func joinFetch(ctx context.Context, uri string) *sharedFetch {
+	sharedFetchesLock.Lock()
+	defer sharedFetchesLock.Unlock()
+	f, ok := sharedFetches[uri]
+	if !ok {
+		f = &sharedFetch{}
+		f.ctx, f.cancel = context.WithCancel(ctx)
+		sharedFetches[uri] = f
+	}
+	f.waiters++
+	return f
+}
+
+// Unregister a client or a task waiting for the fetch of uri, and cancel the
+// fetch if it was the last one
+func leaveFetch(uri string, f *sharedFetch) {
+	sharedFetchesLock.Lock()
+	defer sharedFetchesLock.Unlock()
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	if sharedFetches[uri] == f {
+		delete(sharedFetches, uri)
+	}
+}
@@ -0,0 +1,83 @@
+package httpapi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A context for a client, that goes away when done is closed
+func clientContext(done chan struct{}) context.Context {
+	return context.WithValue(context.Background(), clientDoneKey, (<-chan struct{})(done))
+}
+
+// Wait until n clients or tasks are waiting for the fetch of uri
+func waitForWaiters(t *testing.T, uri string, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		sharedFetchesLock.Lock()
+		f := sharedFetches[uri]
+		ok := f != nil && f.waiters == n
+		sharedFetchesLock.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("there are not %d waiters for %s", n, uri)
+}
+
+func TestFetchSharedCancelled(t *testing.T) {
+	uri := "http://a.example/cancelled.png"
+	done := make(chan struct{})
+	cancelled := make(chan struct{})
+	client := make(chan error)
+	go func() {
+		client <- fetchShared(clientContext(done), uri, func(ctx context.Context) error {
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		})
+	}()
+	waitForWaiters(t, uri, 1)
+	close(done)
+	if err := <-client; err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("the fetch is not cancelled when its only client has gone")
+	}
+}
+
+func TestFetchSharedWithBackgroundTask(t *testing.T) {
+	uri := "http://a.example/background.png"
+	done := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	client := make(chan error)
+	go func() { client <- fetchShared(clientContext(done), uri, fetch) }()
+	waitForWaiters(t, uri, 1)
+	task := make(chan error)
+	go func() { task <- fetchShared(withoutClient(clientContext(done)), uri, fetch) }()
+	waitForWaiters(t, uri, 2)
+
+	// The client goes away, but the task still waits for the fetch
+	close(done)
+	if err := <-client; err != context.Canceled {
+		t.Errorf("client: err = %v, want context.Canceled", err)
+	}
+	close(release)
+	if err := <-task; err != nil {
+		t.Errorf("the fetch of the background task has been cancelled: %v", err)
+	}
+}
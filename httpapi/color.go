@@ -0,0 +1,43 @@
+package httpapi
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/nfnt/resize"
+)
+
+// Compute the dominant color of the images when they are cached
+var dominantColors bool
+
+// The width of the thumbnail used for computing the dominant color, in pixels
+const DominantColorWidth = 32
+
+// Compute the dominant color of an image, and save it in redis
+func (srv *Server) saveDominantColor(uri string, img image.Image) {
+	small := resize.Resize(DominantColorWidth, 0, img, resize.Bilinear)
+	if color := averageColor(small); color != "" {
+		srv.redis.HSet(srv.keyPrefix+uri, "color", color)
+	}
+}
+
+// The average color of an image, as #rrggbb. The transparent pixels are
+// ignored, and an empty string is returned for a fully transparent image.
+func averageColor(img image.Image) string {
+	var r, g, b, a uint64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pr, pg, pb, pa := img.At(x, y).RGBA()
+			r += uint64(pr)
+			g += uint64(pg)
+			b += uint64(pb)
+			a += uint64(pa)
+		}
+	}
+	if a == 0 {
+		return ""
+	}
+	// The components are premultiplied by alpha
+	return fmt.Sprintf("#%02x%02x%02x", r*0xff/a, g*0xff/a, b*0xff/a)
+}
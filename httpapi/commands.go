@@ -0,0 +1,170 @@
+package httpapi
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The commands of the binary, with their arguments. Without a command, the
+// daemon is started (serve).
+var commands = map[string]string{
+	"serve":         "",
+	"purge":         "URL...",
+	"stats":         "",
+	"gc":            "",
+	"warm":          "FILE (or - for stdin)",
+	"migrate-cache": "-from OLDDIR -to NEWDIR [options]",
+}
+
+// Split the command-line between the command and its options
+func parseCommand(args []string) (command string, rest []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return "serve", args
+}
+
+// Print the usage, with the list of the commands and the options
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [options] [arguments]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s %s\n", name, commands[name])
+	}
+	fmt.Fprintf(out, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// Run a maintenance command, with the same configuration as the daemon,
+// and give its exit code
+func (srv *Server) runCommand(command string, args []string) int {
+	switch command {
+	case "purge":
+		return srv.purgeCommand(args)
+	case "stats":
+		return srv.statsCommand()
+	case "gc":
+		if err := srv.checkScan(); err != nil {
+			fmt.Fprintln(os.Stderr, "GC:", err)
+			return 1
+		}
+		srv.collectGarbage()
+		return 0
+	case "warm":
+		return srv.warmCommand(args)
+	}
+	usage()
+	return 2
+}
+
+// Remove images from the cache, as with DELETE /img/<encoded_url>
+func (srv *Server) purgeCommand(uris []string) int {
+	if len(uris) == 0 {
+		usage()
+		return 2
+	}
+	code := 0
+	for _, uri := range uris {
+		normalized, err := srv.parseImageURL(uri)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid URL %s: %s\n", uri, err)
+			code = 1
+			continue
+		}
+		srv.purgeFromCache(normalized)
+		fmt.Printf("Purged %s\n", normalized)
+	}
+	return code
+}
+
+// Print the number of cached images and errors, and the size of the cache
+func (srv *Server) statsCommand() int {
+	uris, err := srv.cachedURLs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Redis:", err)
+		return 1
+	}
+	errors, err := srv.countKeys(srv.keyPrefix + "err/*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Redis:", err)
+		return 1
+	}
+	size, _ := srv.redis.Get(srv.keyPrefix + "size").Int64()
+	fmt.Printf("Cached images: %d\n", len(uris))
+	fmt.Printf("Cached errors: %d\n", errors)
+	fmt.Printf("Size of the cache: %d bytes\n", size)
+	return 0
+}
+
+// Count the keys in redis matching a pattern
+func (srv *Server) countKeys(pattern string) (count int, err error) {
+	if err = srv.checkScan(); err != nil {
+		return
+	}
+	var cursor int64
+	for {
+		var keys []string
+		cursor, keys, err = srv.redis.Scan(cursor, pattern, GCScanCount).Result()
+		if err != nil {
+			return
+		}
+		count += len(keys)
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// Fetch the images listed in a file (one URL per line), to warm the cache
+// before the readers ask for them
+func (srv *Server) warmCommand(args []string) int {
+	if len(args) != 1 {
+		usage()
+		return 2
+	}
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	code := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uri, err := srv.parseImageURL(line)
+		if err == nil {
+			err = srv.prefetchImage(context.Background(), uri)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error on %s: %s\n", line, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("Warmed %s\n", uri)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return code
+}
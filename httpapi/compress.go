@@ -0,0 +1,89 @@
+package httpapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+// The content-types of the images that are worth compressing
+var compressibleTypes = map[string]bool{
+	"image/svg+xml": true,
+	"image/bmp":     true,
+	"image/x-icon":  true,
+}
+
+// Choose the encoding for the response from the Accept-Encoding header
+// of the request: br if the client accepts it, else gzip, else none
+func acceptedEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted[coding] = true
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					accepted[coding] = false
+				}
+			}
+		}
+	}
+	for _, coding := range []string{"br", "gzip"} {
+		if accepted[coding] {
+			return coding
+		}
+	}
+	return ""
+}
+
+// Compress the body with the given encoding
+func compress(body io.Reader, encoding string) (compressed []byte, err error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if encoding == "br" {
+		w = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	if _, err = io.Copy(w, body); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+// Negotiate the Content-Encoding for the compressible images, and give the
+// body (compressed or not) to send. The ETag is different for each encoding.
+// The original body is closed when it is replaced by the compressed one.
+func compressBody(w http.ResponseWriter, r *http.Request, headers *Headers, body io.ReadSeekCloser) io.ReadSeekCloser {
+	if !compressibleTypes[headers.contentType] {
+		return body
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := acceptedEncoding(r)
+	if encoding == "" {
+		return body
+	}
+
+	compressed, err := compress(body, encoding)
+	if err != nil {
+		body.Seek(0, io.SeekStart)
+		return body
+	}
+	body.Close()
+	w.Header().Set("Content-Encoding", encoding)
+	if headers.etag != "" {
+		headers.etag = strings.TrimSuffix(headers.etag, `"`) + "-" + encoding + `"`
+	}
+	return cache.NewBytesFile(compressed)
+}
@@ -0,0 +1,40 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The origins allowed to use the images in a canvas or with WebGL
+// (comma-separated, or * for all of them)
+var corsOrigins string
+
+// The value of the Cross-Origin-Resource-Policy header (none if empty)
+var resourcePolicy string
+
+// Add the CORS headers to the response of an image
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	if resourcePolicy != "" {
+		w.Header().Set("Cross-Origin-Resource-Policy", resourcePolicy)
+	}
+	if corsOrigins == "" {
+		return
+	}
+	if corsOrigins == "*" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	// The response depends on the origin of the request
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, allowed := range strings.Split(corsOrigins, ",") {
+		if strings.TrimSpace(allowed) == origin {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			return
+		}
+	}
+}
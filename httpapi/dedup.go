@@ -0,0 +1,87 @@
+package httpapi
+
+import (
+	"fmt"
+	"os"
+)
+
+// Store the bodies of the images under their checksum, so the identical
+// images fetched from several URLs are stored only once
+var dedup bool
+
+// The key in the store for the body of an image with this checksum
+func blobKey(checksum string) string {
+	if len(checksum) < 7 {
+		return "blobs/" + checksum
+	}
+	return fmt.Sprintf("blobs/%s/%s/%s/%s", checksum[0:2], checksum[2:4], checksum[4:6], checksum[6:])
+}
+
+// The key in the store for the body of the image cached for uri: its blob,
+// if it was saved with dedup, or a key derived from uri
+func (srv *Server) cacheKey(uri string) string {
+	if hget := srv.redis.HGet(srv.keyPrefix+uri, "blob"); hget.Err() == nil && hget.Val() != "" {
+		return blobKey(hget.Val())
+	}
+	return srv.uriKey(uri)
+}
+
+// The checksum of the blob used by uri, or "" if it was saved without dedup
+func (srv *Server) blobOf(uri string) string {
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "blob")
+	if hget.Err() != nil {
+		return ""
+	}
+	return hget.Val()
+}
+
+// Count a new reference on the blob with this checksum. The size of the blob
+// is added to the size of the cache only for its first reference.
+func (srv *Server) retainBlob(checksum string, size int64) {
+	incr := srv.redis.IncrBy(srv.keyPrefix+"blob/"+checksum, 1)
+	if incr.Err() == nil && incr.Val() == 1 {
+		srv.redis.IncrBy(srv.keyPrefix+"size", size)
+	}
+}
+
+// Remove a reference on the blob with this checksum, and delete it with del
+// when it is not used anymore
+func (srv *Server) releaseBlob(checksum string, size int64, del func(key string) error) error {
+	incr := srv.redis.IncrBy(srv.keyPrefix+"blob/"+checksum, -1)
+	if incr.Err() != nil || incr.Val() > 0 {
+		return incr.Err()
+	}
+	srv.redis.Del(srv.keyPrefix + "blob/" + checksum)
+	srv.redis.IncrBy(srv.keyPrefix+"size", -size)
+	err := del(blobKey(checksum))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// Release the blob used by uri, if any, when its body is replaced or evicted
+func (srv *Server) releaseBlobOf(uri string, del func(key string) error) error {
+	checksum := srv.blobOf(uri)
+	if checksum == "" {
+		return nil
+	}
+	size := srv.cachedSize(uri)
+	srv.redis.HDel(srv.keyPrefix+uri, "blob")
+	return srv.releaseBlob(checksum, size, del)
+}
+
+// Make uri use the blob with this checksum. The new blob is retained before
+// the previous one is released, so a body that has not changed is never
+// deleted from the store.
+func (srv *Server) switchBlob(uri, checksum string, size int64) {
+	previous := srv.blobOf(uri)
+	if previous == checksum {
+		return
+	}
+	srv.retainBlob(checksum, size)
+	if previous != "" {
+		srv.releaseBlob(previous, srv.cachedSize(uri), srv.store.Delete)
+	}
+	srv.redis.HSet(srv.keyPrefix+uri, "blob", checksum)
+}
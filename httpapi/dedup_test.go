@@ -0,0 +1,75 @@
+package httpapi
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// Save body in the cache for uri, and fail the test on error
+func saveTestImage(t *testing.T, srv *Server, uri, body string) {
+	t.Helper()
+	if err := srv.saveImageInCache(context.Background(), uri, "image/png", strings.NewReader(body)); err != nil {
+		t.Fatalf("save %s: %s", uri, err)
+	}
+}
+
+func TestDedupSharedBlob(t *testing.T) {
+	srv := setupCache(t)
+	dedup = true
+	defer func() { dedup = false }()
+
+	saveTestImage(t, srv, "http://a.example/1.png", "same body")
+	saveTestImage(t, srv, "http://b.example/2.png", "same body")
+	checksum := srv.blobOf("http://a.example/1.png")
+	if checksum == "" || srv.blobOf("http://b.example/2.png") != checksum {
+		t.Fatalf("both images should use the same blob")
+	}
+	if n := redisInt(t, srv, "blob/"+checksum); n != 2 {
+		t.Errorf("refcount = %d, want 2", n)
+	}
+	if n := redisInt(t, srv, "size"); n != int64(len("same body")) {
+		t.Errorf("cache size = %d, want the size of one blob", n)
+	}
+
+	srv.evictFromCache("http://a.example/1.png")
+	if _, err := srv.store.Stat(blobKey(checksum)); err != nil {
+		t.Errorf("the blob was deleted while still used: %s", err)
+	}
+	srv.evictFromCache("http://b.example/2.png")
+	if _, err := srv.store.Stat(blobKey(checksum)); err == nil {
+		t.Errorf("the blob is not deleted after its last reference")
+	}
+	if n := redisInt(t, srv, "size"); n != 0 {
+		t.Errorf("cache size = %d, want 0", n)
+	}
+}
+
+func TestDedupReplacedBody(t *testing.T) {
+	srv := setupCache(t)
+	dedup = true
+	defer func() { dedup = false }()
+
+	uri := "http://a.example/1.png"
+	saveTestImage(t, srv, uri, "old body")
+	old := srv.blobOf(uri)
+	saveTestImage(t, srv, uri, "a new body")
+	if srv.blobOf(uri) == old {
+		t.Fatalf("the blob has not changed")
+	}
+	if _, err := srv.store.Stat(blobKey(old)); err == nil {
+		t.Errorf("the previous blob is still in the store")
+	}
+	if _, err := srv.store.Stat(blobKey(srv.blobOf(uri))); err != nil {
+		t.Errorf("the new blob is not in the store: %s", err)
+	}
+
+	// Saving a blob again for the same URL doesn't release it
+	srv.switchBlob(uri, srv.blobOf(uri), int64(len("a new body")))
+	if n := redisInt(t, srv, "blob/"+srv.blobOf(uri)); n != 1 {
+		t.Errorf("refcount = %d, want 1", n)
+	}
+	if n := redisInt(t, srv, "size"); n != int64(len("a new body")) {
+		t.Errorf("cache size = %d, want %d", n, len("a new body"))
+	}
+}
@@ -0,0 +1,90 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// The error given by urlStatus when redis can't be reached
+var ErrRedisUnavailable = errors.New("Redis is unavailable")
+
+// Keep serving images when redis is unavailable
+var degradedMode bool
+
+// Set to 1 while redis is unavailable
+var degraded int32
+
+// Remember if redis is available, and log when it changes
+func setDegraded(on bool, err error) {
+	if on {
+		if atomic.CompareAndSwapInt32(&degraded, 0, 1) {
+			log.Printf("Redis is unavailable, the daemon is degraded: %s\n", err)
+			reportError(context.Background(), err, "")
+		}
+	} else if atomic.CompareAndSwapInt32(&degraded, 1, 0) {
+		log.Printf("Redis is available again\n")
+	}
+}
+
+// How many images are remembered for the degraded mode
+const DegradedEntries = 100000
+
+// What is needed to serve a cached image without redis
+type degradedEntry struct {
+	key     string
+	headers Headers
+}
+
+// The images served while redis was available, with the key of their body
+// in the store (their blob with dedup) and their headers. The blocked images
+// are removed, so the degraded mode serves only what redis allowed recently.
+var degradedImages = struct {
+	sync.Mutex
+	entries map[string]degradedEntry
+}{entries: make(map[string]degradedEntry)}
+
+// Remember how to serve the image for uri if redis becomes unavailable
+func rememberImage(uri, key string, headers Headers) {
+	if !degradedMode {
+		return
+	}
+	degradedImages.Lock()
+	defer degradedImages.Unlock()
+	if _, ok := degradedImages.entries[uri]; !ok && len(degradedImages.entries) >= DegradedEntries {
+		// The map is full: drop a random entry
+		for other := range degradedImages.entries {
+			delete(degradedImages.entries, other)
+			break
+		}
+	}
+	degradedImages.entries[uri] = degradedEntry{key, headers}
+}
+
+// Forget the image for uri, when it is blocked, replaced or evicted
+func forgetImage(uri string) {
+	degradedImages.Lock()
+	defer degradedImages.Unlock()
+	delete(degradedImages.entries, uri)
+}
+
+// Serve the image without redis, but only if it has been served since
+// redis was last available: an unknown URL is never fetched, as redis is
+// needed to check that it has been registered by the main site.
+func (srv *Server) fetchImageDegraded(uri string) (headers Headers, body io.ReadSeekCloser, err error) {
+	degradedImages.Lock()
+	entry, ok := degradedImages.entries[uri]
+	degradedImages.Unlock()
+	if !ok {
+		return headers, nil, ErrRedisUnavailable
+	}
+	body, _, err = srv.store.Open(entry.key)
+	if err != nil {
+		forgetImage(uri)
+		return headers, nil, ErrRedisUnavailable
+	}
+	return entry.headers, body, nil
+}
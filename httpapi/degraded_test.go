@@ -0,0 +1,40 @@
+package httpapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDegradedServesOnlyKnownImages(t *testing.T) {
+	srv := setupCache(t)
+	degradedMode = true
+	defer func() { degradedMode = false }()
+
+	uri := "http://a.example/1.png"
+	if err := srv.store.Put(srv.uriKey(uri), strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.fetchImageDegraded(uri); err != ErrRedisUnavailable {
+		t.Errorf("an image never served is served in degraded mode: %v", err)
+	}
+
+	rememberImage(uri, srv.uriKey(uri), Headers{contentType: "image/png", nsfw: true})
+	headers, body, err := srv.fetchImageDegraded(uri)
+	if err != nil {
+		t.Fatalf("a known image is not served: %s", err)
+	}
+	body.Close()
+	if !headers.nsfw {
+		t.Errorf("the nsfw flag is lost in degraded mode")
+	}
+
+	// Blocking the image while redis is available forgets it
+	srv.redis.HSet(srv.keyPrefix+uri, "created_at", "1")
+	srv.redis.HSet(srv.keyPrefix+uri, "status", "Blocked")
+	if err := srv.urlStatus(uri); err != ErrBlocked {
+		t.Fatalf("urlStatus = %v, want ErrBlocked", err)
+	}
+	if _, _, err := srv.fetchImageDegraded(uri); err != ErrRedisUnavailable {
+		t.Errorf("a blocked image is still served: %v", err)
+	}
+}
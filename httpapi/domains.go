@@ -0,0 +1,79 @@
+package httpapi
+
+import (
+	"bufio"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The error when the domain of an image is refused
+var ErrBlockedDomain = errors.New("Blocked domain")
+
+// Parse a list of domains: comma-separated, or read from a file with @
+func parseDomains(value string) (domains []string, err error) {
+	entries := strings.Split(value, ",")
+	if strings.HasPrefix(value, "@") {
+		entries = nil
+		file, err := os.Open(value[1:])
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			entries = append(entries, scanner.Text())
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" && !strings.HasPrefix(entry, "#") {
+			domains = append(domains, entry)
+		}
+	}
+	return
+}
+
+// Check if host is one of the domains. A domain can be exact (example.com)
+// or a wildcard for its subdomains (*.example.com).
+func matchDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		if strings.HasPrefix(domain, "*.") {
+			if strings.HasSuffix(host, domain[1:]) {
+				return true
+			}
+		} else if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the images can be fetched from this host
+func checkHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	s := currentSettings()
+	if matchDomain(host, s.blockedDomainList) {
+		return ErrBlockedDomain
+	}
+	if len(s.allowedDomainList) > 0 && !matchDomain(host, s.allowedDomainList) {
+		return ErrBlockedDomain
+	}
+	return nil
+}
+
+// Check that the image at uri can be fetched and served
+func checkDomain(uri string) error {
+	if s := currentSettings(); len(s.blockedDomainList) == 0 && len(s.allowedDomainList) == 0 {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	return checkHost(u.Hostname())
+}
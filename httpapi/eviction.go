@@ -0,0 +1,145 @@
+package httpapi
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+	redis "gopkg.in/redis.v3"
+)
+
+// How often the evictor checks the size of the cache
+const EvictionInterval = 1 * time.Minute
+
+// How many entries are evicted at once
+const EvictionBatch = 100
+
+// The maximal size of the cache directory, in bytes (0 for no limit)
+var maxCacheSize int64
+
+// Remember that the cached image for uri has been used,
+// so the least recently used images are evicted first
+func (srv *Server) touchCache(uri string) {
+	if maxCacheSize <= 0 {
+		return
+	}
+	srv.redis.ZAdd(srv.keyPrefix+"lru", redis.Z{Score: float64(time.Now().Unix()), Member: uri})
+}
+
+// Keep track of the total size of the cache when a file is written.
+// counted is what the previous body of uri counted in this total.
+func (srv *Server) updateCacheSize(uri string, size, counted int64) {
+	srv.redis.HSet(srv.keyPrefix+uri, "size", strconv.FormatInt(size, 10))
+	srv.redis.IncrBy(srv.keyPrefix+"size", srv.countedSize(uri)-counted)
+	srv.touchCache(uri)
+}
+
+// The size of the cached file for uri, as stored in redis
+func (srv *Server) cachedSize(uri string) int64 {
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "size")
+	if hget.Err() != nil {
+		return 0
+	}
+	size, _ := strconv.ParseInt(hget.Val(), 10, 64)
+	return size
+}
+
+// What the cached file for uri counts in the total size of the cache: the
+// blobs shared with dedup are counted once, by retainBlob and releaseBlob
+func (srv *Server) countedSize(uri string) int64 {
+	if srv.blobOf(uri) != "" {
+		return 0
+	}
+	return srv.cachedSize(uri)
+}
+
+// Evict uri from the cache, for the LRU and the garbage collector: its files
+// are only deleted from the local tier of the store, if it has one
+func (srv *Server) evictFromCache(uri string) {
+	srv.removeFromCache(uri, srv.deleteLocal)
+}
+
+// Delete uri from the cache and from all the tiers of the store, for the
+// purges, the blocked images and the corrupted files
+func (srv *Server) deleteFromCache(uri string) {
+	srv.removeFromCache(uri, srv.store.Delete)
+}
+
+// Delete the file for key from the local tier of the store only, when it
+// has one: the copy in the shared tier is kept for the other instances
+func (srv *Server) deleteLocal(key string) error {
+	if deleter, ok := srv.store.(cache.LocalDeleter); ok {
+		return deleter.DeleteLocal(key)
+	}
+	return srv.store.Delete(key)
+}
+
+// Remove the cached file for uri, its variants, and the metadata we have on it.
+// The files are deleted with del. The created_at and status fields are kept,
+// as they are managed by the main site, so the image will be fetched again if
+// it is requested.
+func (srv *Server) removeFromCache(uri string, del func(key string) error) {
+	removeHotImage(uri)
+	forgetImage(uri)
+	size := srv.countedSize(uri) + srv.deleteVariants(uri, del)
+
+	err := srv.releaseBlobOf(uri, del)
+	if err == nil {
+		err = del(generateKeyForCache(uri))
+		srv.removeLegacyFile(uri, del)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		// The entry is removed anyway, so the evictor doesn't pick it
+		// again: the file is now an orphan, for the garbage collector
+		log.Printf("Error while evicting %s: %s\n", uri, err)
+	}
+	srv.redis.HDel(srv.keyPrefix+uri, "type", "checksum", "etag", "last_modified", "refresh", "size", "sha256", "placeholder", "blurhash", "color", "validated_at", "source_sha1", "source_sha256", "undecodable")
+	srv.redis.Del(srv.keyPrefix + "updated/" + uri)
+	srv.redis.ZRem(srv.keyPrefix+"lru", uri)
+	srv.redis.IncrBy(srv.keyPrefix+"size", -size)
+}
+
+// Evict the least recently used images until the cache fits in maxCacheSize.
+// It stops if the entries of a batch are still in the LRU after it, as the
+// next batches would be the same.
+func (srv *Server) evictCache() {
+	var previous string
+	for {
+		get := srv.redis.Get(srv.keyPrefix + "size")
+		if get.Err() != nil {
+			return
+		}
+		total, err := get.Int64()
+		if err != nil || total <= maxCacheSize {
+			return
+		}
+
+		zrange := srv.redis.ZRange(srv.keyPrefix+"lru", 0, EvictionBatch-1)
+		if zrange.Err() != nil || len(zrange.Val()) == 0 {
+			return
+		}
+		if zrange.Val()[0] == previous {
+			log.Printf("The cache is too large (%d bytes), but the eviction makes no progress\n", total)
+			return
+		}
+		previous = zrange.Val()[0]
+		log.Printf("The cache is too large (%d bytes), evict %d images\n", total, len(zrange.Val()))
+		for _, uri := range zrange.Val() {
+			srv.evictFromCache(uri)
+		}
+	}
+}
+
+// Periodically evict images from the cache when it is too large
+func (srv *Server) startEvictor() {
+	if maxCacheSize <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(EvictionInterval) {
+			srv.evictCache()
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+	redis "gopkg.in/redis.v3"
+)
+
+// A store where the files can't be deleted
+type undeletableStore struct {
+	cache.Store
+}
+
+func (s undeletableStore) Delete(key string) error {
+	return errors.New("Read-only file system")
+}
+
+func TestEvictCache(t *testing.T) {
+	srv := setupCache(t)
+	defer func(size int64) { maxCacheSize = size }(maxCacheSize)
+	maxCacheSize = 10
+
+	saveTestImage(t, srv, "http://a.example/1.png", "first image")
+	saveTestImage(t, srv, "http://a.example/2.png", "second image")
+	srv.evictCache()
+	if n := redisInt(t, srv, "size"); n > maxCacheSize {
+		t.Errorf("cache size = %d after the eviction", n)
+	}
+	if zrange := srv.redis.ZRange(srv.keyPrefix+"lru", 0, -1); len(zrange.Val()) != 0 {
+		t.Errorf("the LRU still has %v", zrange.Val())
+	}
+}
+
+func TestEvictCacheDeleteError(t *testing.T) {
+	srv := setupCache(t)
+	defer func(size int64) { maxCacheSize = size }(maxCacheSize)
+	maxCacheSize = 10
+
+	saveTestImage(t, srv, "http://a.example/1.png", "first image")
+	saveTestImage(t, srv, "http://a.example/2.png", "second image")
+	srv.store = undeletableStore{srv.store}
+
+	// Must return, even if the files can't be deleted
+	srv.evictCache()
+	if zrange := srv.redis.ZRange(srv.keyPrefix+"lru", 0, -1); len(zrange.Val()) != 0 {
+		t.Errorf("the LRU still has %v", zrange.Val())
+	}
+
+	// Evicting an unknown entry doesn't make the size negative
+	srv.redis.ZAdd(srv.keyPrefix+"lru", redis.Z{Score: 1, Member: "http://a.example/3.png"})
+	srv.redis.IncrBy(srv.keyPrefix+"size", 100)
+	srv.evictCache()
+	if n := redisInt(t, srv, "size"); n != 100 {
+		t.Errorf("cache size = %d, want 100", n)
+	}
+}
+
+func TestHotHitTouchesCache(t *testing.T) {
+	srv := setupCache(t)
+	defer func(size, hot, item int64, ttl time.Duration) {
+		maxCacheSize, hotCacheSize, hotCacheMaxItem, hotCacheTTL = size, hot, item, ttl
+	}(maxCacheSize, hotCacheSize, hotCacheMaxItem, hotCacheTTL)
+	maxCacheSize, hotCacheSize, hotCacheMaxItem, hotCacheTTL = 1<<20, 1<<20, 1<<10, time.Hour
+
+	first, second := "http://a.example/1.png", "http://a.example/2.png"
+	srv.redis.ZAdd(srv.keyPrefix+"lru", redis.Z{Score: 1, Member: first}, redis.Z{Score: 2, Member: second})
+	addHotImage(first, Headers{}, cache.NewBytesFile([]byte("hot image")))
+	defer removeHotImage(first)
+
+	// A recent hit is not recorded again
+	if _, _, err := srv.fetchImage(context.Background(), first, imgBehaviour()); err != nil {
+		t.Fatal(err)
+	}
+	if zrange := srv.redis.ZRange(srv.keyPrefix+"lru", 0, 0); len(zrange.Val()) != 1 || zrange.Val()[0] != first {
+		t.Errorf("the LRU starts with %v, the hit is recorded too often", zrange.Val())
+	}
+
+	hotCache.Lock()
+	hotCache.entries[first].Value.(*hotEntry).touchedAt = time.Now().Add(-HotTouchInterval)
+	hotCache.Unlock()
+	if _, _, err := srv.fetchImage(context.Background(), first, imgBehaviour()); err != nil {
+		t.Fatal(err)
+	}
+	if zrange := srv.redis.ZRange(srv.keyPrefix+"lru", 0, 0); len(zrange.Val()) != 1 || zrange.Val()[0] != second {
+		t.Errorf("the LRU starts with %v, the hit in the hot cache is not recorded", zrange.Val())
+	}
+}
+
+func TestEvictKeepsSharedTier(t *testing.T) {
+	srv := setupCache(t)
+	shared, err := cache.NewStore(t.TempDir(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.store = cache.NewTieredStore(srv.store, shared, func(task func()) bool {
+		task()
+		return true
+	})
+
+	saveTestImage(t, srv, "http://a.example/1.png", "first image")
+	saveTestImage(t, srv, "http://a.example/2.png", "second image")
+	srv.evictFromCache("http://a.example/1.png")
+	if _, err := shared.Stat(generateKeyForCache("http://a.example/1.png")); err != nil {
+		t.Errorf("the eviction deleted the file from the shared tier: %v", err)
+	}
+	srv.purgeFromCache("http://a.example/2.png")
+	if _, err := shared.Stat(generateKeyForCache("http://a.example/2.png")); err == nil {
+		t.Errorf("the purge kept the file in the shared tier")
+	}
+}
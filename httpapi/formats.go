@@ -0,0 +1,63 @@
+package httpapi
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+)
+
+// The formats of the images that are cached and served, comma-separated
+// (all the formats if empty)
+var allowedFormats string
+
+// Convert the images in the other formats to PNG, when they can be decoded
+var convertFormats bool
+
+// The content-types for the allowed formats
+var allowedTypes map[string]bool
+
+// The content-types for the names of the formats that are not image/<name>
+var formatTypes = map[string]string{
+	"jpg": "image/jpeg",
+	"svg": "image/svg+xml",
+	"ico": "image/x-icon",
+}
+
+// Parse the list of the allowed formats
+func parseAllowedFormats() {
+	if allowedFormats == "" {
+		return
+	}
+	allowedTypes = make(map[string]bool)
+	for _, name := range strings.Split(allowedFormats, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if contentType, ok := formatTypes[name]; ok {
+			allowedTypes[contentType] = true
+		} else {
+			allowedTypes["image/"+name] = true
+		}
+	}
+}
+
+// Check if the images with this content-type can be cached and served
+func allowedFormat(contentType string) bool {
+	return allowedTypes == nil || allowedTypes[contentType]
+}
+
+// Convert an image to PNG, if PNG is an allowed format
+func convertToPNG(body []byte) ([]byte, error) {
+	if !allowedFormat("image/png") {
+		return nil, ErrInvalidContentType
+	}
+	img, _, err := decodeImage(bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrInvalidContentType
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,125 @@
+package httpapi
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+	redis "gopkg.in/redis.v3"
+)
+
+// How often the garbage collector reconciles the cache and redis (0 to disable)
+var gcInterval time.Duration
+
+// The files younger than this are never collected, as their metadata may
+// not have been written in redis yet
+const GCGracePeriod = 1 * time.Hour
+
+// How many keys are asked to redis for each SCAN
+const GCScanCount = 1000
+
+// The keys in redis that are not the hash of an image
+var gcSkippedPrefixes = []string{"err/", "updated/", "blob/", "banned/", "backoff/", "migration/", "lru", "size"}
+
+// The error when the keys can't all be listed: SCAN only reaches one node
+// of a redis cluster, and the GC would delete the files of the other nodes
+var ErrClusterScan = errors.New("Scanning the keys is not supported with a redis cluster")
+
+// Check that SCAN gives all the keys of the database
+func (srv *Server) checkScan() error {
+	if _, ok := srv.redis.(*redis.ClusterClient); ok {
+		return ErrClusterScan
+	}
+	return nil
+}
+
+// Find the URLs of the images that are cached according to redis
+func (srv *Server) cachedURLs() (uris []string, err error) {
+	if err = srv.checkScan(); err != nil {
+		return
+	}
+	var cursor int64
+	for {
+		var keys []string
+		cursor, keys, err = srv.redis.Scan(cursor, srv.keyPrefix+"*", GCScanCount).Result()
+		if err != nil {
+			return
+		}
+	keys:
+		for _, key := range keys {
+			uri := strings.TrimPrefix(key, srv.keyPrefix)
+			for _, prefix := range gcSkippedPrefixes {
+				if strings.HasPrefix(uri, prefix) {
+					continue keys
+				}
+			}
+			hexists := srv.redis.HExists(key, "type")
+			if hexists.Err() == nil && hexists.Val() {
+				uris = append(uris, uri)
+			}
+		}
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// Reconcile the cache and redis: the metadata of the images without a
+// file are removed, and the files that are unknown to redis are deleted
+func (srv *Server) collectGarbage() {
+	uris, err := srv.cachedURLs()
+	if err != nil {
+		log.Printf("GC: error while scanning redis: %s\n", err)
+		return
+	}
+
+	known := make(map[string]bool, len(uris))
+	stale := 0
+	for _, uri := range uris {
+		key := srv.cacheKey(uri)
+		if _, err := srv.store.Stat(key); os.IsNotExist(err) {
+			srv.evictFromCache(uri)
+			stale++
+			continue
+		}
+		known[key] = true
+		known[generateKeyForCache(uri)] = true
+	}
+
+	orphans := 0
+	if walker, ok := srv.store.(cache.Walker); ok {
+		err = walker.Walk(func(key string, modTime time.Time) error {
+			if known[originalKey(key)] || time.Since(modTime) < GCGracePeriod {
+				return nil
+			}
+			if err := srv.deleteLocal(key); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			orphans++
+			return nil
+		})
+		if err != nil {
+			log.Printf("GC: error while walking the cache: %s\n", err)
+		}
+	}
+	log.Printf("GC: %d stale entries in redis and %d orphaned files removed\n", stale, orphans)
+}
+
+// Periodically run the garbage collector
+func (srv *Server) startGC() {
+	if gcInterval <= 0 {
+		return
+	}
+	if err := srv.checkScan(); err != nil {
+		log.Printf("GC disabled: %s\n", err)
+		return
+	}
+	go func() {
+		for range time.Tick(gcInterval) {
+			srv.collectGarbage()
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The key of the file written in the store to check that it is writable
+const HealthKey = ".healthz"
+
+// The duration for which the result of the check of the store is reused
+const StoreCheckInterval = 10 * time.Second
+
+// The last check of the store, shared by /healthz and /readyz
+var storeCheck struct {
+	sync.Mutex
+	at  time.Time
+	err error
+}
+
+// The result of the check of a dependency
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// The result of the health check, for the monitoring
+type healthReport struct {
+	OK       bool                   `json:"ok"`
+	Checks   map[string]healthCheck `json:"checks"`
+	DiskFree *uint64                `json:"disk_free,omitempty"`
+	Degraded bool                   `json:"degraded"`
+}
+
+// Build a healthCheck from an error
+func checkResult(err error) healthCheck {
+	if err != nil {
+		return healthCheck{false, err.Error()}
+	}
+	return healthCheck{OK: true}
+}
+
+// Check that redis answers
+func (srv *Server) checkRedis() error {
+	return srv.redis.Ping().Err()
+}
+
+// Check that the store is writable, by writing and removing a small file
+func (srv *Server) checkStore() error {
+	if err := srv.store.Put(HealthKey, strings.NewReader("ok")); err != nil {
+		return err
+	}
+	return srv.store.Delete(HealthKey)
+}
+
+// Check the store at most once per StoreCheckInterval, as the probes can
+// hit the health checks several times per second
+func (srv *Server) cachedCheckStore() error {
+	storeCheck.Lock()
+	defer storeCheck.Unlock()
+	if storeCheck.at.IsZero() || time.Since(storeCheck.at) >= StoreCheckInterval {
+		storeCheck.err = srv.checkStore()
+		storeCheck.at = time.Now()
+	}
+	return storeCheck.err
+}
+
+// Check the dependencies of the daemon: redis and the cache
+func (srv *Server) checkHealth() (report healthReport) {
+	report.Checks = map[string]healthCheck{
+		"redis": checkResult(srv.checkRedis()),
+		"store": checkResult(srv.cachedCheckStore()),
+	}
+	report.OK = true
+	for _, check := range report.Checks {
+		report.OK = report.OK && check.OK
+	}
+	if fs, ok := srv.store.(interface{ FreeSpace() (uint64, error) }); ok {
+		if free, err := fs.FreeSpace(); err == nil {
+			report.DiskFree = &free
+		}
+	}
+	report.Degraded = degradedMode && !report.Checks["redis"].OK
+	return
+}
+
+// Respond with the health of the daemon and its dependencies, as JSON,
+// with a 503 if one of them is failing
+func (srv *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	report := srv.checkHealth()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Respond 200 while the process is up (liveness)
+func Livez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "OK")
+}
+
+// Respond 200 if the daemon can serve images (readiness): redis is
+// reachable (or the degraded mode is enabled), the cache is writable, and
+// the process is not shutting down. Else, respond 503.
+func (srv *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	var err error
+	if atomic.LoadInt32(&draining) == 1 {
+		err = errors.New("Shutting down")
+	} else if err = srv.checkRedis(); err != nil && degradedMode {
+		err = nil
+	}
+	if err == nil {
+		err = srv.cachedCheckStore()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
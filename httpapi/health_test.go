@@ -0,0 +1,42 @@
+package httpapi
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+type countingStore struct {
+	cache.Store
+	puts *int
+}
+
+func (s countingStore) Put(key string, r io.Reader) error {
+	*s.puts++
+	return s.Store.Put(key, r)
+}
+
+func TestCachedCheckStore(t *testing.T) {
+	srv := setupCache(t)
+	puts := 0
+	srv.store = countingStore{srv.store, &puts}
+	storeCheck.at = time.Time{}
+
+	for i := 0; i < 3; i++ {
+		if err := srv.cachedCheckStore(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if puts != 1 {
+		t.Errorf("the store was written %d times, expected once", puts)
+	}
+
+	// The store is checked again once the result is too old
+	storeCheck.at = time.Now().Add(-StoreCheckInterval)
+	srv.cachedCheckStore()
+	if puts != 2 {
+		t.Errorf("the store was written %d times, expected twice", puts)
+	}
+}
@@ -0,0 +1,165 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// The maximal number of concurrent fetches on the same host (0 for no limit)
+var maxFetchesPerHost int
+
+// A semaphore for the fetches on a host, with the number of goroutines
+// using it, so it can be removed when nobody needs it anymore
+type hostSemaphore struct {
+	slots chan struct{}
+	users int
+}
+
+// The semaphores of the hosts with fetches in progress
+var hostSemaphores = struct {
+	sync.Mutex
+	m map[string]*hostSemaphore
+}{m: make(map[string]*hostSemaphore)}
+
+// Wait for a slot to fetch an image on host, or for the end of ctx,
+// and return the function to call to release it
+func acquireHost(ctx context.Context, host string) (release func(), err error) {
+	if maxFetchesPerHost <= 0 {
+		return func() {}, nil
+	}
+
+	hostSemaphores.Lock()
+	sem, ok := hostSemaphores.m[host]
+	if !ok {
+		sem = &hostSemaphore{slots: make(chan struct{}, maxFetchesPerHost)}
+		hostSemaphores.m[host] = sem
+	}
+	sem.users++
+	hostSemaphores.Unlock()
+
+	leave := func() {
+		hostSemaphores.Lock()
+		sem.users--
+		if sem.users == 0 {
+			delete(hostSemaphores.m, host)
+		}
+		hostSemaphores.Unlock()
+	}
+	select {
+	case sem.slots <- struct{}{}:
+	case <-ctx.Done():
+		leave()
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-sem.slots
+		leave()
+	}, nil
+}
+
+// The error when we don't try to fetch an image as its host is failing
+var ErrCircuitOpen = errors.New("The host is failing, circuit open")
+
+// Stop fetching from a host after this number of consecutive failures
+var breakerThreshold int
+
+// How long we wait before trying again to fetch from a failing host
+var breakerCooldown time.Duration
+
+// How long a circuit is kept after the cooldown without any failure or probe
+const CircuitIdleTimeout = 10 * time.Minute
+
+// How often the idle circuits are removed
+const CircuitCleanInterval = 1 * time.Minute
+
+// The state of the circuit breaker for a host
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+	last      time.Time
+}
+
+// The circuits of the hosts that have failed recently
+var circuits = struct {
+	sync.Mutex
+	m map[string]*circuit
+}{m: make(map[string]*circuit)}
+
+// Check if we can fetch an image from host. When the circuit is open, we
+// wait for the cooldown, and then we let a single fetch probe the host.
+func allowFetch(host string) bool {
+	if breakerThreshold <= 0 {
+		return true
+	}
+	circuits.Lock()
+	defer circuits.Unlock()
+	c, ok := circuits.m[host]
+	if !ok || c.failures < breakerThreshold {
+		return true
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false
+	}
+	c.probing = true
+	c.last = time.Now()
+	return true
+}
+
+// Record the result of a fetch on host, to open or close its circuit
+func recordFetch(host string, success bool) {
+	if breakerThreshold <= 0 {
+		return
+	}
+	circuits.Lock()
+	defer circuits.Unlock()
+	if success {
+		if _, ok := circuits.m[host]; ok {
+			log.Printf("Circuit closed for %s\n", host)
+			delete(circuits.m, host)
+		}
+		return
+	}
+	c, ok := circuits.m[host]
+	if !ok {
+		c = &circuit{}
+		circuits.m[host] = c
+	}
+	c.failures++
+	c.probing = false
+	c.last = time.Now()
+	if c.failures >= breakerThreshold {
+		if c.failures == breakerThreshold {
+			log.Printf("Circuit open for %s after %d failures\n", host, c.failures)
+		}
+		c.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// Remove the circuits of the hosts that have not failed nor been probed for
+// a while: the failures are not consecutive anymore, and a probe that never
+// ended doesn't block the host forever
+func expireCircuits(now time.Time) {
+	circuits.Lock()
+	defer circuits.Unlock()
+	for host, c := range circuits.m {
+		if now.Sub(c.last) > breakerCooldown+CircuitIdleTimeout {
+			delete(circuits.m, host)
+		}
+	}
+}
+
+// Periodically remove the idle circuits
+func startCircuitsCleaner() {
+	if breakerThreshold <= 0 {
+		return
+	}
+	go func() {
+		for now := range time.Tick(CircuitCleanInterval) {
+			expireCircuits(now)
+		}
+	}()
+}
@@ -0,0 +1,59 @@
+package httpapi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireHostDeadline(t *testing.T) {
+	defer func(n int) { maxFetchesPerHost = n }(maxFetchesPerHost)
+	maxFetchesPerHost = 1
+
+	release, err := acquireHost(context.Background(), "a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := acquireHost(ctx, "a.example"); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	release()
+
+	hostSemaphores.Lock()
+	defer hostSemaphores.Unlock()
+	if _, ok := hostSemaphores.m["a.example"]; ok {
+		t.Errorf("the semaphore of the host is not removed")
+	}
+}
+
+func TestExpireCircuits(t *testing.T) {
+	defer func(n int, d time.Duration) { breakerThreshold, breakerCooldown = n, d }(breakerThreshold, breakerCooldown)
+	breakerThreshold, breakerCooldown = 2, time.Minute
+
+	recordFetch("idle.example", false)
+	recordFetch("stuck.example", false)
+	recordFetch("stuck.example", false)
+	circuits.Lock()
+	circuits.m["stuck.example"].openUntil = time.Now()
+	circuits.Unlock()
+	if !allowFetch("stuck.example") || allowFetch("stuck.example") {
+		t.Fatalf("a single probe should be allowed")
+	}
+
+	expireCircuits(time.Now())
+	if allowFetch("stuck.example") {
+		t.Errorf("the circuit is expired too soon")
+	}
+	expireCircuits(time.Now().Add(breakerCooldown + CircuitIdleTimeout + time.Second))
+	circuits.Lock()
+	n := len(circuits.m)
+	circuits.Unlock()
+	if n != 0 {
+		t.Errorf("%d idle circuits are kept", n)
+	}
+	if !allowFetch("stuck.example") {
+		t.Errorf("the host is still blocked by a probe that never ended")
+	}
+}
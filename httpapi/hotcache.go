@@ -0,0 +1,134 @@
+package httpapi
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+// The maximal size of the hot cache in memory, in bytes (0 to disable it)
+var hotCacheSize int64
+
+// The images larger than this are not kept in the hot cache
+var hotCacheMaxItem int64
+
+// How long an image is served from the hot cache before checking redis again
+var hotCacheTTL time.Duration
+
+// The number of images served from the hot cache
+var hotHits int64
+
+// How often the hits of an image in the hot cache are recorded for the
+// eviction of the cached files, to not write in redis on each hit
+const HotTouchInterval = 1 * time.Minute
+
+// An image in the hot cache, with its headers
+type hotEntry struct {
+	uri       string
+	headers   Headers
+	body      []byte
+	expiresAt time.Time
+	touchedAt time.Time
+}
+
+// A LRU cache in memory for the most requested images (the avatars of the
+// front page for example), bounded by the total size of the images
+var hotCache = struct {
+	sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}{entries: make(map[string]*list.Element), lru: list.New()}
+
+// Give the image for uri if it is in the hot cache
+func getHotImage(uri string) (headers Headers, body io.ReadSeekCloser, ok bool) {
+	if hotCacheSize <= 0 {
+		return
+	}
+	hotCache.Lock()
+	defer hotCache.Unlock()
+	elt, ok := hotCache.entries[uri]
+	if !ok {
+		return
+	}
+	entry := elt.Value.(*hotEntry)
+	if time.Now().After(entry.expiresAt) {
+		removeHotElement(elt)
+		return headers, nil, false
+	}
+	hotCache.lru.MoveToFront(elt)
+	atomic.AddInt64(&hotHits, 1)
+	return entry.headers, cache.NewBytesFile(entry.body), true
+}
+
+// Tell if a hit of uri in the hot cache must be recorded for the eviction:
+// once per HotTouchInterval at most
+func hotTouchDue(uri string) bool {
+	hotCache.Lock()
+	defer hotCache.Unlock()
+	elt, ok := hotCache.entries[uri]
+	if !ok {
+		return false
+	}
+	entry := elt.Value.(*hotEntry)
+	now := time.Now()
+	if now.Sub(entry.touchedAt) < HotTouchInterval {
+		return false
+	}
+	entry.touchedAt = now
+	return true
+}
+
+// Keep a small image in the hot cache. The body is read and rewound.
+func addHotImage(uri string, headers Headers, body io.ReadSeeker) {
+	if hotCacheSize <= 0 {
+		return
+	}
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil || size > hotCacheMaxItem || size > hotCacheSize {
+		body.Seek(0, io.SeekStart)
+		return
+	}
+	all := make([]byte, size)
+	_, err = body.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.ReadFull(body, all)
+	}
+	body.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	hotCache.Lock()
+	defer hotCache.Unlock()
+	if elt, ok := hotCache.entries[uri]; ok {
+		removeHotElement(elt)
+	}
+	now := time.Now()
+	entry := &hotEntry{uri, headers, all, now.Add(hotCacheTTL), now}
+	hotCache.entries[uri] = hotCache.lru.PushFront(entry)
+	hotCache.size += size
+	for hotCache.size > hotCacheSize {
+		removeHotElement(hotCache.lru.Back())
+	}
+}
+
+// Remove the image for uri from the hot cache
+func removeHotImage(uri string) {
+	hotCache.Lock()
+	defer hotCache.Unlock()
+	if elt, ok := hotCache.entries[uri]; ok {
+		removeHotElement(elt)
+	}
+}
+
+// Remove an element of the hot cache (the lock must be held)
+func removeHotElement(elt *list.Element) {
+	entry := hotCache.lru.Remove(elt).(*hotEntry)
+	delete(hotCache.entries, entry.uri)
+	hotCache.size -= int64(len(entry.body))
+}
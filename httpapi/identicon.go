@@ -0,0 +1,104 @@
+package httpapi
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+// The identicons are grids of IdenticonCells x IdenticonCells
+const IdenticonCells = 5
+
+// Generate identicons for the missing avatars, instead of the default avatar
+var identicons bool
+
+// The hash of the user for an avatar: the gravatar URLs already end with
+// the MD5 of the email, and for the other URLs, we hash the whole URL
+func userHash(uri string) []byte {
+	if h, err := hex.DecodeString(path.Base(uri)); err == nil && len(h) == md5.Size {
+		return h
+	}
+	h := md5.Sum([]byte(uri))
+	return h[:]
+}
+
+// Render the identicon for a hash, as a PNG image: a symmetric grid of
+// cells, with a color taken from the hash
+func renderIdenticon(hash []byte) ([]byte, error) {
+	cell := AvatarHeight / (IdenticonCells + 1)
+	margin := (AvatarHeight - cell*IdenticonCells) / 2
+	img := image.NewNRGBA(image.Rect(0, 0, AvatarHeight, AvatarHeight))
+	background := color.NRGBA{0xf0, 0xf0, 0xf0, 0xff}
+	foreground := color.NRGBA{64 + hash[0]%160, 64 + hash[1]%160, 64 + hash[2]%160, 0xff}
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	bit := 0
+	for x := 0; x < (IdenticonCells+1)/2; x++ {
+		for y := 0; y < IdenticonCells; y++ {
+			on := hash[3+bit/8]&(1<<uint(bit%8)) != 0
+			bit++
+			if !on {
+				continue
+			}
+			for _, col := range []int{x, IdenticonCells - 1 - x} {
+				r := image.Rect(margin+col*cell, margin+y*cell, margin+(col+1)*cell, margin+(y+1)*cell)
+				draw.Draw(img, r, &image.Uniform{foreground}, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Respond with the identicon for the avatar in the request. They never
+// change, so the browsers can keep them for a long time.
+func (srv *Server) identiconHandler(w http.ResponseWriter, r *http.Request) {
+	uri, err := srv.decodeURL(r)
+	if err != nil {
+		defaultAvatarHandler(w, r)
+		return
+	}
+	hash := userHash(uri)
+	key := "identicon/" + hex.EncodeToString(hash)
+	headers, body, ok := getHotImage(key)
+	if !ok {
+		data, err := renderIdenticon(hash)
+		if err != nil {
+			defaultAvatarHandler(w, r)
+			return
+		}
+		headers = Headers{
+			contentType:  "image/png",
+			cacheControl: publicCacheControl(ImmutableMaxAge),
+			etag:         `"` + hex.EncodeToString(hash) + `"`,
+		}
+		body = cache.NewBytesFile(data)
+		addHotImage(key, headers, body)
+	}
+	w.Header().Set("ETag", headers.etag)
+	w.Header().Set("Content-Type", headers.contentType)
+	w.Header().Set("Cache-Control", headers.cacheControl)
+	http.ServeContent(w, r, "", time.Time{}, body)
+}
+
+// Respond for a missing or broken avatar
+func (srv *Server) missingAvatar(w http.ResponseWriter, r *http.Request) {
+	if identicons {
+		srv.identiconHandler(w, r)
+		return
+	}
+	defaultAvatarHandler(w, r)
+}
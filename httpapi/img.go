@@ -0,0 +1,1495 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+	"github.com/nfnt/resize"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+)
+
+// The URL for the default avatar
+const DefaultAvatarUrl = "//linuxfr.org/images/default-avatar.png"
+
+// The default maximal size for an image is 5MB
+const MaxSize = 5 * (1 << 20)
+
+// The error for the images larger than the maximal size
+var ErrExceededMaxSize = errors.New("Exceeded max size")
+
+// The error for the bodies that are not images
+var ErrInvalidContentType = errors.New("Invalid content-type")
+
+// The number of bytes used to sniff the content-type
+const SniffLen = 512
+
+// Force the height of the avatar, width is computed to preserve ratio
+const AvatarHeight = 64
+
+// Refresh the cache once per hour, if the server doesn't say otherwise
+const CacheRefreshInterval = 1 * time.Hour
+
+// HTTP headers struct
+type Headers struct {
+	contentType  string
+	lastModified string
+	cacheControl string
+	etag         string
+	color        string
+	nsfw         bool
+	warning      string
+	stale        bool
+	cache        string
+	cachedAt     time.Time
+	refreshAt    time.Time
+}
+
+// Behaviour is a way to customize handlers
+type Behaviour struct {
+	// Manipulate the image fetched from uri before sending it (resize for
+	// example). When nil, the image is streamed to the cache without being
+	// modified.
+	Manipulate func(uri string, body []byte) []byte
+	// NotFound is called when we can't find a valid image at the original location
+	NotFound func(http.ResponseWriter, *http.Request)
+	// Blocked is called when the image has been blocked (NotFound if nil)
+	Blocked func(http.ResponseWriter, *http.Request)
+	// Unavailable is called when the image can't be fetched for a transient
+	// reason, with the delay before retrying (NotFound if nil)
+	Unavailable func(http.ResponseWriter, *http.Request, time.Duration)
+	// MaxSize is the maximal size of the images, in bytes
+	MaxSize int64
+	// RedirectOnError sends the browser to the original URL when the image
+	// can't be fetched or cached, instead of calling NotFound
+	RedirectOnError bool
+}
+
+// The behaviour for normal images
+var ImgBehaviour = Behaviour{
+	nil,
+	notFoundHandler,
+	blockedHandler,
+	unavailableHandler,
+	MaxSize,
+	false,
+}
+
+// The behaviour for avatars (NotFound is the missing avatar of the server)
+var AvatarBehaviour = Behaviour{
+	func(uri string, body []byte) []byte {
+		img, format, err := decodeImage(bytes.NewReader(body))
+		if err != nil {
+			return body
+		}
+		m := resize.Resize(0, AvatarHeight, img, resize.Lanczos3)
+		var buf bytes.Buffer
+		switch format {
+		case "png":
+			png.Encode(&buf, m)
+		case "jpeg":
+			jpeg.Encode(&buf, m, nil)
+		}
+		if buf.Len() == 0 {
+			return body
+		}
+		return buf.Bytes()
+	},
+	nil,
+	nil,
+	nil,
+	MaxSize,
+	false,
+}
+
+// Keep serving the cached copy of an image when it can't be refreshed
+var staleIfError bool
+
+// The max-age for the content-addressed variants of the images (one year)
+const ImmutableMaxAge = 365 * 24 * time.Hour
+
+// The fetches in progress, by URL
+var fetchGroup singleflight.Group
+
+// The bounds for the refresh interval asked by the distant servers
+var (
+	minRefreshInterval time.Duration
+	maxRefreshInterval time.Duration
+)
+
+// headerFlag is a flag that can be repeated to give several HTTP headers
+type headerFlag http.Header
+
+// String is used by the flag package to display the headers
+func (h headerFlag) String() string {
+	var lines []string
+	for name, values := range h {
+		for _, value := range values {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+// Set adds a header given as "Name: value"
+func (h headerFlag) Set(line string) error {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return errors.New("Invalid header, expected Name: value")
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// The limits on the connections of the clients, against the slow or
+// malicious ones
+var (
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+)
+
+// The error when the URL of an image has not been registered by the main site
+var ErrUnknownURL = errors.New("Invalid URL")
+
+// Check if an URL is valid and not temporary in error
+func (srv *Server) urlStatus(uri string) error {
+	hexists := srv.redis.HExists(srv.keyPrefix+uri, "created_at")
+	if err := hexists.Err(); err != nil {
+		setDegraded(true, err)
+		return ErrRedisUnavailable
+	}
+	setDegraded(false, nil)
+	if ok := hexists.Val(); !ok {
+		forgetImage(uri)
+		return ErrUnknownURL
+	}
+
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "status")
+	if err := hget.Err(); err == nil {
+		if status := hget.Val(); status == "Blocked" {
+			forgetImage(uri)
+			return ErrBlocked
+		}
+	}
+
+	get := srv.redis.Get(srv.keyPrefix + "err/" + uri)
+	if err := get.Err(); err == nil {
+		return parseCachedError(get.Val())
+	}
+
+	return nil
+}
+
+// Generate a key for cache from a string, with the layout given by the flags
+func generateKeyForCache(s string) string {
+	return shardedKey(s, shardHash, shardDepth)
+}
+
+// Format a mtime for the Last-Modified header
+func formatModTime(mtime time.Time) (modTime string, err error) {
+	gmt, err := time.LoadLocation("GMT")
+	if err != nil {
+		return
+	}
+	modTime = mtime.In(gmt).Format(time.RFC1123)
+	return
+}
+
+// Retrieve mtime of the cached file
+func (srv *Server) getModTime(uri string) (modTime string, err error) {
+	mtime, err := srv.store.Stat(srv.cacheKey(uri))
+	if err != nil {
+		return
+	}
+	return formatModTime(mtime)
+}
+
+// How long the cached image for uri is kept before being refreshed: the
+// refresh asked by its server, or CacheRefreshInterval
+func (srv *Server) refreshInterval(uri string) time.Duration {
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "refresh")
+	if hget.Err() == nil {
+		if secs, err := strconv.Atoi(hget.Val()); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return CacheRefreshInterval
+}
+
+// Tell the cache that the metadata we have for that URL is still valid
+func (srv *Server) resetCacheTimer(uri string) {
+	mtime, err := srv.getModTime(uri)
+	if err != nil {
+		log.Printf("Couldn't Get mtime while resetting cache timer for %s: %s\n", uri, err)
+		return
+	}
+	srv.redis.Set(srv.keyPrefix+"updated/"+uri, mtime, srv.refreshInterval(uri))
+	srv.redis.HSet(srv.keyPrefix+uri, "validated_at", strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+// Save how long the image can be cached before being refreshed, from the
+// Cache-Control and Expires headers of the distant server
+func (srv *Server) saveRefreshInterval(uri string, h http.Header) {
+	interval, ok := maxAge(h)
+	if !ok {
+		srv.redis.HDel(srv.keyPrefix+uri, "refresh")
+		return
+	}
+	if interval < minRefreshInterval {
+		interval = minRefreshInterval
+	}
+	if interval > maxRefreshInterval {
+		interval = maxRefreshInterval
+	}
+	secs := int(interval / time.Second)
+	srv.redis.HSet(srv.keyPrefix+uri, "refresh", strconv.Itoa(secs))
+}
+
+// Find how long a response can be cached from its headers
+func maxAge(h http.Header) (time.Duration, bool) {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0, true
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil {
+				return time.Duration(secs) * time.Second, true
+			}
+		}
+	}
+
+	if expires := h.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// An invalid date means already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return t.Sub(date), true
+	}
+
+	return 0, false
+}
+
+// Fetch image from cache. A corrupted file is treated as a miss: it is
+// removed from the cache, and the image is fetched again.
+func (srv *Server) fetchImageFromCache(ctx context.Context, uri string, behaviour Behaviour) (headers Headers, body io.ReadSeekCloser, err error) {
+	headers, body, err = srv.openCachedImage(ctx, uri, behaviour)
+	if err == ErrInvalidChecksum {
+		logf(ctx, "The cached file for %s is corrupted\n", uri)
+		srv.deleteFromCache(uri)
+		headers, body, err = srv.openCachedImage(ctx, uri, behaviour)
+	}
+	return
+}
+
+// Open the cached image, after fetching or refreshing it if needed
+func (srv *Server) openCachedImage(ctx context.Context, uri string, behaviour Behaviour) (headers Headers, body io.ReadSeekCloser, err error) {
+	err = nil
+	headers.cache = "hit"
+
+	exists := srv.redis.Exists(srv.keyPrefix + "updated/" + uri)
+	if exists.Err() != nil || !exists.Val() {
+		// If we already have the image, we serve it immediately while
+		// it is refreshed in the background
+		hexists := srv.redis.HExists(srv.keyPrefix+uri, "type")
+		if hexists.Err() == nil && hexists.Val() {
+			headers.stale = true
+			headers.cache = "stale"
+			srv.scheduleRefresh(ctx, uri, behaviour)
+		} else {
+			headers.cache = "miss"
+			// Concurrent requests for the same image share a single fetch
+			err = fetchShared(ctx, uri, func(ctx context.Context) error {
+				return srv.fetchImageFromServer(ctx, uri, behaviour)
+			})
+			// When the host is failing, we serve the stale image if we have one
+			if err == ErrCircuitOpen {
+				err = nil
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	cached, body, err := srv.openCachedFile(ctx, uri)
+	cached.stale, cached.cache = headers.stale, headers.cache
+	return cached, body, err
+}
+
+// Open the cached file of an image, and give its headers
+func (srv *Server) openCachedFile(ctx context.Context, uri string) (headers Headers, body io.ReadSeekCloser, err error) {
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "type")
+	if err = hget.Err(); err != nil {
+		return
+	}
+	contentType := hget.Val()
+
+	// The checksum of the body is used as a strong ETag
+	hget = srv.redis.HGet(srv.keyPrefix+uri, "checksum")
+	if hget.Err() == nil && hget.Val() != "" {
+		headers.etag = `"` + hget.Val() + `"`
+	}
+	if hget = srv.redis.HGet(srv.keyPrefix+uri, "color"); hget.Err() == nil {
+		headers.color = hget.Val()
+	}
+	hexists := srv.redis.HExists(srv.keyPrefix+uri, "nsfw")
+	headers.nsfw = hexists.Err() == nil && hexists.Val()
+	if srv.checkScan() != nil && srv.bannedImage(uri) {
+		srv.blockBannedImage(uri)
+		return headers, nil, ErrBlocked
+	}
+
+	key := srv.cacheKey(uri)
+	_, span := startSpan(ctx, "store.open")
+	body, mtime, err := srv.store.Open(key)
+	if err == nil {
+		if err = srv.checkCachedFile(uri, body); err != nil {
+			body.Close()
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		return
+	}
+	lastModified, err := formatModTime(mtime)
+	if err != nil {
+		body.Close()
+		return
+	}
+
+	headers.contentType = contentType
+	headers.lastModified = lastModified
+	if hget = srv.redis.HGet(srv.keyPrefix+uri, "validated_at"); hget.Err() == nil {
+		if secs, err := strconv.ParseInt(hget.Val(), 10, 64); err == nil {
+			headers.cachedAt = time.Unix(secs, 0)
+			headers.refreshAt = headers.cachedAt.Add(srv.refreshInterval(uri))
+		}
+	}
+	rememberImage(uri, key, headers)
+
+	return
+}
+
+// The URLs of the images with a refresh in the queue
+var pendingRefreshes sync.Map
+
+// Queue the refresh of a cached image, if it is not already queued
+func (srv *Server) scheduleRefresh(ctx context.Context, uri string, behaviour Behaviour) {
+	if _, queued := pendingRefreshes.LoadOrStore(uri, true); queued {
+		return
+	}
+	ok := enqueue(func() {
+		defer pendingRefreshes.Delete(uri)
+		srv.refreshImage(ctx, uri, behaviour)
+	})
+	if !ok {
+		pendingRefreshes.Delete(uri)
+	}
+}
+
+// Refresh a cached image, from a background worker. It may have been
+// refreshed by a request while the task was waiting in the queue.
+func (srv *Server) refreshImage(ctx context.Context, uri string, behaviour Behaviour) (err error) {
+	exists := srv.redis.Exists(srv.keyPrefix + "updated/" + uri)
+	if exists.Err() == nil && exists.Val() {
+		return
+	}
+	// The refresh goes on if the client that asked for it goes away
+	return fetchShared(withoutClient(ctx), uri, func(ctx context.Context) error {
+		return srv.fetchImageFromServer(ctx, uri, behaviour)
+	})
+}
+
+// Save the validators of the distant server (ETag and Last-Modified headers),
+// to make conditional requests when the cache will be refreshed
+func (srv *Server) saveValidators(uri string, etag string, lastModified string) {
+	if etag == "" {
+		srv.redis.HDel(srv.keyPrefix+uri, "etag")
+	} else {
+		srv.redis.HSet(srv.keyPrefix+uri, "etag", etag)
+	}
+	if lastModified == "" {
+		srv.redis.HDel(srv.keyPrefix+uri, "last_modified")
+	} else {
+		srv.redis.HSet(srv.keyPrefix+uri, "last_modified", lastModified)
+	}
+}
+
+// Save the body and the content-type header in cache.
+// The body is first written in a temporary file, to compute its checksum
+// without keeping the whole image in memory.
+func (srv *Server) saveImageInCache(ctx context.Context, uri string, contentType string, body io.Reader) (err error) {
+	tmp, err := ioutil.TempFile("", "img-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha1.New()
+	h256 := sha256.New()
+	size, err := copyWithPool(tmp, io.TeeReader(body, io.MultiWriter(h, h256)))
+	if err != nil {
+		logf(ctx, "Error while downloading %s: %s\n", uri, err)
+		return
+	}
+	checksum := fmt.Sprintf("%x", h.Sum(nil))
+	sum256 := fmt.Sprintf("%x", h256.Sum(nil))
+
+	// The moderators can ban an image, whatever its URL
+	if srv.bannedChecksum(checksum, sum256) {
+		logf(ctx, "%s has a banned content\n", uri)
+		srv.blockBannedImage(uri)
+		return ErrBannedContent
+	}
+
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "checksum")
+	if err = hget.Err(); err == nil {
+		if was := hget.Val(); checksum == was {
+			srv.resetCacheTimer(uri)
+			return
+		}
+	}
+
+	// Save the body in the store
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	// With dedup, the body is not written again if another URL has the same content
+	key, exists := generateKeyForCache(uri), false
+	if dedup {
+		key = blobKey(checksum)
+		_, err = srv.store.Stat(key)
+		exists = err == nil
+	}
+	if !exists {
+		_, span := startSpan(ctx, "store.put", attribute.Int64("size", size))
+		err = srv.store.Put(key, tmp)
+		endSpan(span, err)
+		if err != nil {
+			logf(ctx, "Error while writing %s: %s\n", uri, err)
+			reportError(ctx, err, uri)
+			return
+		}
+		if err = srv.verifyChecksum(key, checksum); err != nil {
+			logf(ctx, "Error while writing %s: %s\n", uri, err)
+			reportError(ctx, err, uri)
+			srv.store.Delete(key)
+			return
+		}
+	}
+	srv.removeLegacyFile(uri, srv.store.Delete)
+
+	// The blob of the previous body is not used by this image anymore
+	counted := srv.countedSize(uri)
+	if dedup {
+		srv.switchBlob(uri, checksum, size)
+		srv.store.Delete(generateKeyForCache(uri))
+	} else {
+		srv.releaseBlobOf(uri, srv.store.Delete)
+	}
+	removeHotImage(uri)
+	forgetImage(uri)
+	if placeholders || dominantColors {
+		if _, err := tmp.Seek(0, io.SeekStart); err == nil {
+			srv.analyzeImage(uri, tmp)
+		}
+	}
+
+	// And other infos in redis
+	srv.redis.HSet(srv.keyPrefix+uri, "type", contentType)
+	srv.redis.HSet(srv.keyPrefix+uri, "checksum", checksum)
+	srv.redis.HSet(srv.keyPrefix+uri, "sha256", sum256)
+	srv.updateCacheSize(uri, size, counted)
+	srv.resetCacheTimer(uri)
+
+	return
+}
+
+// The error when a cached file doesn't match its checksum
+var ErrInvalidChecksum = errors.New("Invalid checksum")
+
+// The SHA1 checksum of a body, as an hexadecimal string
+func computeChecksum(body io.Reader) (checksum string, err error) {
+	h := sha1.New()
+	if _, err = copyWithPool(h, body); err != nil {
+		return
+	}
+	checksum = fmt.Sprintf("%x", h.Sum(nil))
+	return
+}
+
+// Verify the checksum of the cached files on each read, not only their size
+var verifyChecksums bool
+
+// Check that a cached file has not been truncated (or damaged by bit rot if
+// verifyChecksums is set), and rewind it
+func (srv *Server) checkCachedFile(uri string, body io.ReadSeeker) error {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "size")
+	if hget.Err() == nil && hget.Val() != strconv.FormatInt(size, 10) {
+		return ErrInvalidChecksum
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if !verifyChecksums {
+		return nil
+	}
+
+	hget = srv.redis.HGet(srv.keyPrefix+uri, "checksum")
+	if hget.Err() != nil {
+		return nil
+	}
+	checksum, err := computeChecksum(body)
+	if err != nil {
+		return err
+	}
+	if checksum != hget.Val() {
+		return ErrInvalidChecksum
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	return err
+}
+
+// Check that the file in the store for key has the expected checksum
+func (srv *Server) verifyChecksum(key string, expected string) error {
+	body, _, err := srv.store.Open(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	checksum, err := computeChecksum(body)
+	if err != nil {
+		return err
+	}
+	if checksum != expected {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+// Save the error in redis, for a duration depending on its class
+func (srv *Server) saveErrorInCache(uri string, err error) {
+	duration := errorDuration(err)
+	if duration <= 0 {
+		return
+	}
+	enqueue(func() {
+		srv.redis.Set(srv.keyPrefix+"err/"+uri, errorValue(err), duration)
+	})
+}
+
+// The URL to fetch for an image: the one where it has permanently moved, or
+// the original URL
+func (srv *Server) fetchURL(uri string) string {
+	if hget := srv.redis.HGet(srv.keyPrefix+uri, "moved_to"); hget.Err() == nil && hget.Val() != "" {
+		return hget.Val()
+	}
+	return uri
+}
+
+// Send the request for the image to the distant server, and check its
+// response. The response is either a 200, or a 304.
+func (srv *Server) requestImage(ctx context.Context, uri string, maxSize int64) (res *http.Response, err error) {
+	target := srv.fetchURL(uri)
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		logf(ctx, "Error on http.NewRequest GET %s: %s\n", uri, err)
+		return
+	}
+	if err = fetcher.ValidateURL(req.URL); err != nil {
+		logf(ctx, "Invalid URL %s: %s\n", uri, err)
+		return
+	}
+	if err = checkHost(req.URL.Hostname()); err != nil {
+		logf(ctx, "Refused URL %s: %s\n", uri, err)
+		return
+	}
+	// Conditional request: the server can respond 304 Not Modified
+	hget := srv.redis.HGet(srv.keyPrefix+uri, "etag")
+	if err = hget.Err(); err == nil {
+		etag := hget.Val()
+		req.Header.Set("If-None-Match", etag)
+	}
+	hget = srv.redis.HGet(srv.keyPrefix+uri, "last_modified")
+	if err = hget.Err(); err == nil {
+		req.Header.Set("If-Modified-Since", hget.Val())
+	}
+
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if srv.backedOff(req.URL.Host) {
+		err = ErrHostBackoff
+		return
+	}
+	if !allowFetch(req.URL.Host) {
+		err = ErrCircuitOpen
+		return
+	}
+	sctx, span := startSpan(ctx, "upstream.get", attribute.String("url", uri))
+	injectTrace(sctx, req.Header)
+	res, err = srv.fetcher.Do(req, currentSettings().timeouts)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+	}
+	endSpan(span, err)
+	// The fetch was cancelled as its clients have gone, it's not an error
+	// of the server
+	if ctx.Err() != nil {
+		if err == nil {
+			res.Body.Close()
+		}
+		return nil, ctx.Err()
+	}
+	recordFetch(req.URL.Host, err == nil && res.StatusCode < 500)
+	if err != nil {
+		logf(ctx, "Error on GET %s: %s\n", uri, err)
+		srv.saveErrorInCache(uri, err)
+		return
+	}
+
+	if res.StatusCode == 304 {
+		return
+	}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		srv.recordBackoff(res)
+	}
+	if res.StatusCode != 200 {
+		infof(ctx, "Status code of %s is: %d\n", uri, res.StatusCode)
+		err = &statusError{res.StatusCode}
+		// The image may have moved again: the next fetch starts from the
+		// original URL
+		if target != uri && !transientError(err) {
+			srv.redis.HDel(srv.keyPrefix+uri, "moved_to")
+		}
+	} else if res.ContentLength > maxSize {
+		logf(ctx, "Exceeded max size for %s: %d\n", uri, res.ContentLength)
+		err = ErrExceededMaxSize
+	}
+	if err != nil {
+		res.Body.Close()
+		res = nil
+		srv.saveErrorInCache(uri, err)
+		return
+	}
+
+	// Content-Length can be missing or wrong
+	res.Body = &maxSizeReader{res.Body, maxSize}
+	return
+}
+
+// maxSizeReader returns an error if the body is larger than the max size
+type maxSizeReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read from the body, and fail when too many bytes have been read
+func (m *maxSizeReader) Read(p []byte) (n int, err error) {
+	n, err = m.ReadCloser.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		err = ErrExceededMaxSize
+	}
+	return
+}
+
+// Find the content-type of an image from its first bytes. The content-type
+// sent by the server is only used to tell SVG from other XML documents.
+func sniffContentType(head []byte, claimed string) (string, error) {
+	sniffed := http.DetectContentType(head)
+	if strings.HasPrefix(sniffed, "image/") {
+		return sniffed, nil
+	}
+
+	// AVIF and HEIF images are ISO-BMFF files, with a ftyp box
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "avif", "avis":
+			return "image/avif", nil
+		case "heic", "heix", "mif1":
+			return "image/heic", nil
+		}
+	}
+
+	// SVG images are XML documents
+	if strings.HasPrefix(sniffed, "text/xml") || strings.HasPrefix(sniffed, "text/plain") {
+		if strings.HasPrefix(claimed, "image/svg+xml") && bytes.Contains(head, []byte("<svg")) {
+			return "image/svg+xml", nil
+		}
+	}
+
+	return "", ErrInvalidContentType
+}
+
+// Fetch the image from the distant server, and save it in cache
+func (srv *Server) fetchImageFromServer(ctx context.Context, uri string, behaviour Behaviour) (err error) {
+	ctx, span := startSpan(ctx, "fetch", attribute.String("url", uri))
+	defer func() { endSpan(span, err) }()
+
+	// The slot for the host is taken first, as we may wait for it: a global
+	// slot is never held by a fetch that is only waiting
+	if u, err := url.Parse(uri); err == nil {
+		release, err := acquireHost(ctx, u.Host)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if !acquireSlot(fetchSlots) {
+		return ErrOverloaded
+	}
+	defer releaseSlot(fetchSlots)
+
+	res, err := srv.requestImage(ctx, uri, behaviour.MaxSize)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 304 {
+		srv.saveRefreshInterval(uri, res.Header)
+		srv.resetCacheTimer(uri)
+		return
+	}
+
+	// Don't trust the content-type sent by the server, sniff it from the body
+	br := getHeaderReader(res.Body)
+	defer putHeaderReader(br)
+	head, _ := br.Peek(HeaderLen)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	contentType, err := sniffContentType(head, res.Header.Get("Content-Type"))
+	if err != nil {
+		logf(ctx, "%s has an invalid content-type: %s\n", uri, res.Header.Get("Content-Type"))
+		srv.saveErrorInCache(uri, err)
+		return
+	}
+
+	// Refuse the decompression bombs before any decoding
+	if err = checkImageHeader(head); err != nil {
+		logf(ctx, "%s has too many pixels\n", uri)
+		srv.saveErrorInCache(uri, err)
+		return
+	}
+	etag := res.Header.Get("ETag")
+	infof(ctx, "Fetch %s (%s) (ETag: %s)\n", uri, contentType, etag)
+
+	// The images in a format that is not allowed are refused, or converted
+	convert := !allowedFormat(contentType)
+	if convert && !convertFormats {
+		logf(ctx, "%s is in a format that is not allowed: %s\n", uri, contentType)
+		srv.saveErrorInCache(uri, ErrInvalidContentType)
+		return ErrInvalidContentType
+	}
+
+	// The body is streamed to the cache, except if it must be converted or
+	// manipulated
+	var body io.Reader = br
+	var sourceSHA1, sourceSHA256 string
+	if convert || behaviour.Manipulate != nil {
+		buf := getBodyBuffer()
+		defer putBodyBuffer(buf)
+		_, err := buf.ReadFrom(br)
+		if err != nil {
+			logf(ctx, "Error while reading %s: %s\n", uri, err)
+			if err == ErrExceededMaxSize {
+				srv.saveErrorInCache(uri, err)
+			}
+			return err
+		}
+		all := buf.Bytes()
+		// The moderators ban the images as published, not as converted
+		sourceSHA1, sourceSHA256 = bodyChecksums(all)
+		if srv.bannedChecksum(sourceSHA1, sourceSHA256) {
+			logf(ctx, "%s has a banned content\n", uri)
+			srv.blockBannedImage(uri)
+			return ErrBannedContent
+		}
+		if convert {
+			if all, err = convertToPNG(all); err != nil {
+				logf(ctx, "Error while converting %s (%s) to PNG: %s\n", uri, contentType, err)
+				srv.saveErrorInCache(uri, ErrInvalidContentType)
+				return err
+			}
+			contentType = "image/png"
+		}
+		if behaviour.Manipulate != nil {
+			all = behaviour.Manipulate(uri, all)
+		}
+		body = bytes.NewReader(all)
+	}
+
+	if srv.urlStatus(uri) == nil {
+		srv.saveValidators(uri, etag, res.Header.Get("Last-Modified"))
+		srv.saveRefreshInterval(uri, res.Header)
+		err = srv.saveImageInCache(ctx, uri, contentType, body)
+		if err == ErrExceededMaxSize {
+			srv.saveErrorInCache(uri, err)
+		}
+		if err == nil {
+			srv.saveSourceChecksums(uri, sourceSHA1, sourceSHA256)
+		}
+		if final := res.Request.URL.String(); final != uri {
+			srv.redis.HSet(srv.keyPrefix+uri, "final_url", final)
+		} else {
+			srv.redis.HDel(srv.keyPrefix+uri, "final_url")
+		}
+		if moved, ok := fetcher.PermanentRedirect(res); ok {
+			srv.redis.HSet(srv.keyPrefix+uri, "moved_to", moved)
+		}
+	}
+	return
+}
+
+// The Cache-Control header for the browsers and the shared caches
+func publicCacheControl(maxAge time.Duration) string {
+	return fmt.Sprintf("public, max-age=%d", maxAge/time.Second)
+}
+
+// The max-age for a cached image. As the Age header counts from its last
+// validation, the clients can keep it until its next refresh, but for at
+// most the max-age of the options from now.
+func (h *Headers) maxAge() time.Duration {
+	maxAge := currentSettings().maxAge
+	age := h.age()
+	if age < 0 {
+		return maxAge
+	}
+	if remaining := time.Until(h.refreshAt); remaining < maxAge {
+		maxAge = remaining
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return age + maxAge
+}
+
+// Check if the request is for a content-addressed variant of the image,
+// ie its v parameter is the checksum of the cached image. Its content can't
+// change, so the browsers don't have to revalidate it.
+func immutableVariant(r *http.Request, headers Headers) bool {
+	version := r.URL.Query().Get("v")
+	return version != "" && headers.etag == `"`+version+`"`
+}
+
+// Fetch image from cache if available, or from the server
+func (srv *Server) fetchImage(ctx context.Context, uri string, behaviour Behaviour) (headers Headers, body io.ReadSeekCloser, err error) {
+	if err = checkDomain(uri); err != nil {
+		return
+	}
+	if headers, body, ok := getHotImage(uri); ok {
+		// The image is still used, even if redis is not asked for it
+		if hotTouchDue(uri) {
+			srv.touchCache(uri)
+		}
+		headers.cache = "hot"
+		headers.cacheControl = publicCacheControl(headers.maxAge())
+		return headers, body, nil
+	}
+
+	_, span := startSpan(ctx, "redis.status")
+	err = srv.urlStatus(uri)
+	endSpan(span, err)
+	if _, ok := err.(*cachedError); ok && staleIfError && (serveGone || !goneError(err)) {
+		if headers, body, serr := srv.openCachedFile(ctx, uri); serr == nil {
+			headers.stale = true
+			headers.cache = "stale"
+			headers.warning = `110 - "Response is Stale"`
+			headers.cacheControl = publicCacheControl(headers.maxAge())
+			return headers, body, nil
+		}
+	}
+	if err == ErrRedisUnavailable && degradedMode {
+		headers, body, err = srv.fetchImageDegraded(uri)
+		headers.cache = "degraded"
+		headers.cacheControl = publicCacheControl(headers.maxAge())
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	headers, body, err = srv.fetchImageFromCache(ctx, uri, behaviour)
+	if err == nil {
+		srv.touchCache(uri)
+	}
+	headers.cacheControl = publicCacheControl(headers.maxAge())
+	if headers.stale {
+		headers.cacheControl += fmt.Sprintf(", stale-while-revalidate=%d", currentSettings().maxAge/time.Second)
+	} else if err == nil {
+		addHotImage(uri, headers, body)
+	}
+
+	return
+}
+
+// Decode the URL of the image from the :encoded_url parameter,
+// check that it is an http(s) URL, and normalize it
+func (srv *Server) decodeURL(r *http.Request) (uri string, err error) {
+	encoded_url := r.URL.Query().Get(":encoded_url")
+	chars, err := hex.DecodeString(encoded_url)
+	if err != nil {
+		infof(r.Context(), "Invalid URL %s\n", encoded_url)
+		return
+	}
+
+	// Only the http and https URLs are proxied, the other schemes
+	// (file, gopher, etc.) are refused before any lookup in the cache
+	uri, err = srv.parseImageURL(string(chars))
+	if err != nil {
+		infof(r.Context(), "Invalid URL %s: %s\n", chars, err)
+	}
+	return
+}
+
+// The Content-Disposition header for the :filename parameter, so "save as"
+// gives a sensible name. With ?dl=1, the image is sent as an attachment.
+func contentDisposition(r *http.Request) string {
+	query := r.URL.Query()
+	filename := strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f || c == '/' || c == '\\' {
+			return -1
+		}
+		return c
+	}, query.Get(":filename"))
+	if filename == "" {
+		return ""
+	}
+	disposition := "inline"
+	if query.Get("dl") == "1" {
+		disposition = "attachment"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
+
+// Receive an HTTP request, fetch the image and respond with it
+func (srv *Server) Image(w http.ResponseWriter, r *http.Request, behaviour Behaviour) {
+	if !allowClient(clientIP(r)) {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	uri, err := srv.decodeURL(r)
+	if err != nil {
+		http.Error(w, "Invalid parameters", 400)
+		return
+	}
+
+	setCORSHeaders(w, r)
+	ctx := withClient(fetchContext(r), r)
+	headers, body, err := srv.fetchImage(ctx, uri, behaviour)
+	setCacheStatus(r.Context(), headers.cache)
+	if err == nil && !allowedFormat(headers.contentType) {
+		body.Close()
+		err = ErrInvalidContentType
+	}
+	if err != nil {
+		w.Header().Set("X-Cache", "ERROR")
+		if isBlocked(err) && behaviour.Blocked != nil {
+			behaviour.Blocked(w, r)
+			return
+		}
+		if behaviour.RedirectOnError && srv.redirectableError(uri, err) {
+			http.Redirect(w, r, uri, http.StatusFound)
+			return
+		}
+		if transientError(err) && behaviour.Unavailable != nil {
+			behaviour.Unavailable(w, r, srv.retryAfter(uri, err))
+			return
+		}
+		behaviour.NotFound(w, r)
+		return
+	}
+	// The variants and the compression close the bodies they replace,
+	// and the body that is served is closed at the end
+	defer func() {
+		if body != nil {
+			body.Close()
+		}
+	}()
+	if immutableVariant(r, headers) {
+		headers.cacheControl = publicCacheControl(ImmutableMaxAge) + ", immutable"
+	}
+	if headers.nsfw && !unblurred(r) {
+		body, err = srv.blurredVariant(ctx, uri, &headers, body)
+		if err != nil {
+			behaviour.NotFound(w, r)
+			return
+		}
+	} else {
+		body = srv.qualityVariant(ctx, uri, requestedQuality(r), &headers, body)
+	}
+	body = compressBody(w, r, &headers, body)
+	if headers.etag != "" {
+		w.Header().Add("ETag", headers.etag)
+	}
+	w.Header().Add("Content-Type", headers.contentType)
+	w.Header().Add("Last-Modified", headers.lastModified)
+	w.Header().Add("Cache-Control", headers.cacheControl)
+	if headers.color != "" {
+		w.Header().Set("X-Dominant-Color", headers.color)
+	}
+	if headers.warning != "" {
+		w.Header().Set("Warning", headers.warning)
+	}
+	w.Header().Set("X-Cache", xCache(headers.cache))
+	if age := headers.age(); age >= 0 {
+		w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	}
+	if disposition := contentDisposition(r); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+
+	// ServeContent handles the conditional (If-None-Match, If-Modified-Since),
+	// Range and HEAD requests for us
+	modTime, _ := http.ParseTime(headers.lastModified)
+	http.ServeContent(w, r, "", modTime, body)
+}
+
+// The X-Cache header for a cache status: HIT (from the hot cache or the
+// store), MISS (fetched for this request) or STALE (not validated)
+func xCache(status string) string {
+	switch status {
+	case "miss":
+		return "MISS"
+	case "stale", "degraded":
+		return "STALE"
+	}
+	return "HIT"
+}
+
+// The time since the image was fetched or validated with its server, or -1
+// if it's unknown (for the images cached before this time was recorded)
+func (h *Headers) age() time.Duration {
+	if h.cachedAt.IsZero() {
+		return -1
+	}
+	if age := time.Since(h.cachedAt); age > 0 {
+		return age
+	}
+	return 0
+}
+
+// Check if the browser can be sent to the original URL of an image after
+// this error. It's only the case when its server can't be reached or is
+// failing: never when we refuse the image (blocked, unknown to the main
+// site, too large, wrong type), nor for the images that must be blurred.
+func (srv *Server) redirectableError(uri string, err error) bool {
+	if !transientError(err) {
+		return false
+	}
+	hexists := srv.redis.HExists(srv.keyPrefix+uri, "nsfw")
+	return hexists.Err() == nil && !hexists.Val()
+}
+
+// Respond with a 503 when an image can't be fetched for a transient reason,
+// and tell the client when to retry
+func unavailableHandler(w http.ResponseWriter, r *http.Request, delay time.Duration) {
+	seconds := int(delay / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	if !serveUnavailableImage(w, r, http.StatusServiceUnavailable) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+// The behaviour for the images, with the current maximal size
+func imgBehaviour() Behaviour {
+	behaviour := ImgBehaviour
+	behaviour.MaxSize = currentSettings().maxSizeKB << 10
+	return behaviour
+}
+
+// The behaviour for the avatars, with the current maximal size
+func (srv *Server) avatarBehaviour() Behaviour {
+	behaviour := AvatarBehaviour
+	behaviour.MaxSize = currentSettings().maxAvatarSizeKB << 10
+	if behaviour.NotFound == nil {
+		behaviour.NotFound = srv.missingAvatar
+	}
+	return behaviour
+}
+
+// Receive an HTTP request for an image and respond with it
+func (srv *Server) Img(w http.ResponseWriter, r *http.Request) {
+	srv.Image(w, r, imgBehaviour())
+}
+
+// Receive an HTTP request for an avatar and respond with it
+func (srv *Server) Avatar(w http.ResponseWriter, r *http.Request) {
+	srv.Image(w, r, srv.avatarBehaviour())
+}
+
+// Returns 200 OK if the server is running (for monitoring)
+func Status(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "OK")
+}
+
+// Main runs the daemon, or one of the maintenance commands, with the options
+// of the command-line
+func Main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	// Maintenance commands
+	command, args := parseCommand(os.Args[1:])
+	if _, ok := commands[command]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+		usage()
+		os.Exit(2)
+	}
+	if command == "migrate-cache" {
+		os.Exit(migrateCacheCommand(args))
+	}
+
+	// Parse the command-line
+	var addr string
+	var logs string
+	var conn string
+	var tlsCert string
+	var tlsKey string
+	var maxCacheSizeMB int64
+	var hotCacheSizeMB int64
+	var defaultAvatarFile string
+	var blockedImageFile string
+	var unavailableImageFile string
+	var imgRedirectOnError, avatarRedirectOnError bool
+	var hotCacheMaxItemKB int64
+	var redisOptions cache.RedisOptions
+	var s3Endpoint, s3Region string
+	var sharedStore string
+	var directory string
+	var keyPrefix string
+	var upstreamOptions fetcher.Options
+	var dnsServers string
+	var upstreamVerify bool
+	extraHeaders := headerFlag{}
+	flag.StringVar(&addr, "a", "127.0.0.1:8000", "Bind to this address:port, or unix:/path/to/socket")
+	flag.StringVar(&socketMode, "socket-mode", "", "The permissions of the unix socket, in octal (eg 0660)")
+	flag.StringVar(&socketOwner, "socket-owner", "", "The owner of the unix socket, as user or user:group")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 5*time.Second, "The timeout for reading the headers of the requests of the clients")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 60*time.Second, "How long an idle keep-alive connection of a client is kept open")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", 16<<10, "The maximal size of the headers of the requests of the clients, in bytes")
+	flag.StringVar(&logs, "l", "-", "Use this file for logs")
+	flag.StringVar(&accessLogFormat, "access-log", "", "Log each request, in the combined log format (combined) or in JSON (json)")
+	flag.StringVar(&conn, "r", "localhost:6379/0", "The redis database to use for caching meta (redis://[user:password@]host:port/db or bolt:///path/to/file.db)")
+	flag.StringVar(&keyPrefix, "redis-prefix", "img/", "The prefix for the keys in redis")
+	flag.BoolVar(&redisOptions.Cluster, "redis-cluster", false, "Use a redis cluster (the hosts in -r are then the seed nodes)")
+	flag.BoolVar(&degradedMode, "degraded-mode", false, "Keep serving images when redis is unavailable")
+	flag.StringVar(&redisOptions.SentinelMaster, "redis-sentinel", "", "The name of the master for redis sentinel (the hosts in -r are then the sentinels)")
+	flag.StringVar(&directory, "d", "cache", "The directory for the caching files (or s3://bucket/prefix)")
+	flag.IntVar(&shardDepth, "shard-depth", LegacyShardDepth, "The number of levels of directories for the cached files")
+	flag.StringVar(&shardHash, "shard-hash", LegacyShardHash, "The hash of the URLs for the names of the cached files (sha1 or sha256)")
+	flag.StringVar(&sharedStore, "shared-store", "", "A store shared by the instances (s3://bucket/prefix), behind the local directory given by -d")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "The endpoint of the S3-compatible storage")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "The region of the S3 bucket")
+	flag.Int64Var(&maxCacheSizeMB, "max-cache-size", 0, "The maximal size of the cache directory in MB (0 for no limit)")
+	flag.StringVar(&urlSecret, "secret", "", "The shared secret for the HMAC-signed URLs, compatible with camo (disabled if empty)")
+	flag.IntVar(&maxWidth, "max-width", 16384, "The maximal width of an image in pixels (0 for no limit)")
+	flag.IntVar(&maxHeight, "max-height", 16384, "The maximal height of an image in pixels (0 for no limit)")
+	flag.Float64Var(&maxMegapixels, "max-megapixels", 50, "The maximal number of pixels of an image in millions (0 for no limit)")
+	flag.StringVar(&allowedFormats, "formats", "", "The formats of the images that are cached and served, comma-separated (eg jpeg,png,gif,webp,svg, all if empty)")
+	flag.BoolVar(&convertFormats, "convert-formats", false, "Convert the images in the other formats to PNG when possible, instead of refusing them")
+	flag.BoolVar(&progressiveJPEG, "progressive-jpeg", false, "Re-encode the baseline JPEGs as progressive ones when they are cached")
+	flag.IntVar(&jpegQuality, "jpeg-quality", 85, "The quality of the re-encoded JPEGs (1-100)")
+	flag.IntVar(&maxQuality, "max-quality", 0, "The maximal quality of the JPEG variants asked with ?q= (0 to disable them)")
+	flag.BoolVar(&placeholders, "placeholders", false, "Compute a placeholder (tiny JPEG and BlurHash) for each cached image, served on /placeholders/<encoded_url>")
+	flag.BoolVar(&dominantColors, "dominant-colors", false, "Compute the dominant color of each cached image, sent in the X-Dominant-Color header")
+	flag.StringVar(&watermark, "watermark", "", "The text written on the large images, {host} being replaced by the host of the image (disabled if empty)")
+	flag.IntVar(&watermarkMinWidth, "watermark-min-width", 400, "The minimal width of the images with a watermark, in pixels")
+	flag.StringVar(&pngOptimizer, "png-optimizer", "", "The command for optimizing the PNG images, from stdin to stdout (eg \"oxipng -o 2 --strip safe -\")")
+	flag.BoolVar(&serveGone, "serve-gone", false, "Serve the last cached copy of the images gone from their server")
+	flag.Var(errorTTLs, "error-ttls", "How long the errors are cached per class (404, 4xx, 5xx, network, timeout, pixels, size, type, private, redirect, blocked), eg 404=1h,network=5m")
+	flag.IntVar(&backgroundWorkers, "workers", 16, "The number of workers for the background refreshes and writes")
+	flag.IntVar(&backgroundQueueSize, "queue-size", 1000, "The maximal number of background tasks waiting for a worker")
+	flag.BoolVar(&staleIfError, "stale-if-error", true, "Keep serving the cached copy of an image when it can't be refreshed")
+	flag.BoolVar(&dedup, "dedup", false, "Store the images under the checksum of their content, to store only once the identical images")
+	flag.BoolVar(&verifyChecksums, "verify-checksums", false, "Verify the checksum of the cached files each time they are read")
+	flag.DurationVar(&gcInterval, "gc-interval", 0, "How often the orphaned cache files and stale redis entries are removed (0 to disable)")
+	flag.Int64Var(&hotCacheSizeMB, "hot-cache-size", 0, "The size of the in-memory cache for the most requested images in MB (0 to disable)")
+	flag.Int64Var(&hotCacheMaxItemKB, "hot-cache-max-item", 64, "The maximal size of an image in the in-memory cache in KB")
+	flag.DurationVar(&hotCacheTTL, "hot-cache-ttl", 1*time.Minute, "How long an image is served from the in-memory cache without checking redis")
+	flag.IntVar(&blockedStatus, "blocked-status", http.StatusUnavailableForLegalReasons, "The status code of the responses for the blocked images")
+	flag.BoolVar(&imgRedirectOnError, "img-redirect-on-error", false, "Redirect the browser to the original URL of an image that can't be fetched, instead of a 404 (less privacy for the readers)")
+	flag.BoolVar(&avatarRedirectOnError, "avatar-redirect-on-error", false, "Redirect the browser to the original URL of an avatar that can't be fetched, instead of the default avatar")
+	flag.StringVar(&unavailableImageFile, "unavailable-image", "", "The image file served for the broken or unavailable images, instead of a bare 404 or 503 (none if empty)")
+	flag.DurationVar(&unavailableMaxAge, "unavailable-max-age", 5*time.Minute, "The max-age of the image served for the unavailable images")
+	flag.StringVar(&blockedImageFile, "blocked-image", "", "The image file served for the blocked images (eg \"content removed\", none if empty)")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "The origins allowed by CORS to use the images, comma-separated or *")
+	flag.StringVar(&resourcePolicy, "resource-policy", "", "The value of the Cross-Origin-Resource-Policy header (eg cross-origin)")
+	flag.StringVar(&defaultAvatarFile, "default-avatar", "", "The image file served for the missing avatars (redirect to "+DefaultAvatarUrl+" if empty)")
+	flag.BoolVar(&identicons, "identicons", false, "Generate identicons for the missing avatars, instead of the default avatar")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "The URL of the OTLP/HTTP collector for the traces (eg http://localhost:4318, disabled if empty)")
+	flag.StringVar(&sentryDSN, "sentry-dsn", "", "The DSN of a Sentry-compatible service for reporting the errors (disabled if empty)")
+	flag.StringVar(&adminAddr, "admin-addr", "", "Serve the pprof profiles on this address:port, that must not be public (disabled if empty)")
+	flag.StringVar(&adminToken, "admin-token", "", "The bearer token for the admin endpoints")
+	flag.StringVar(&adminBasicAuth, "admin-basic-auth", "", "The user:password for the admin endpoints, with basic auth")
+	flag.StringVar(&adminAllow, "admin-allow", "", "The networks allowed to use the admin endpoints (comma-separated CIDRs)")
+	flag.StringVar(&upstreamOptions.UserAgent, "u", "img_LinuxFr.org/1.0", "The User-Agent used for making HTTP requests")
+	flag.DurationVar(&minRefreshInterval, "min-refresh", CacheRefreshInterval, "The minimal interval between two refreshes of an image")
+	flag.DurationVar(&maxRefreshInterval, "max-refresh", 24*time.Hour, "The maximal interval between two refreshes of an image")
+	flag.BoolVar(&upstreamOptions.AllowPrivate, "allow-private", false, "Allow fetching the images on loopback, private and link-local addresses (needed for a proxy given by $HTTP_PROXY on such an address)")
+	flag.StringVar(&upstreamOptions.Proxy, "proxy", "", "The HTTP(S) or SOCKS5 proxy for fetching the images (default to $HTTP_PROXY / $HTTPS_PROXY)")
+	flag.IntVar(&maxRequests, "max-requests", 1000, "The maximal number of requests handled at the same time, beyond which the clients get a 503 (0 for no limit)")
+	flag.IntVar(&maxFetches, "max-fetches", 100, "The maximal number of fetches from the distant servers at the same time (0 for no limit)")
+	flag.IntVar(&maxFetchesPerHost, "max-fetches-per-host", 4, "The maximal number of concurrent fetches on the same host (0 for no limit)")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 5, "Stop fetching from a host after this number of consecutive failures (0 to disable)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 1*time.Minute, "How long to wait before trying again a failing host")
+	flag.DurationVar(&upstreamOptions.DNSTTL, "dns-ttl", 5*time.Minute, "How long the DNS responses are cached (0 to disable)")
+	flag.StringVar(&dnsServers, "dns-servers", "", "The DNS servers to use instead of the system resolver (host:port, comma-separated)")
+	flag.IntVar(&upstreamOptions.MaxRedirects, "max-redirects", 5, "The maximal number of redirects to follow for fetching an image")
+	flag.Var(extraHeaders, "H", "An extra header (Name: value) for the HTTP requests, can be repeated")
+	flag.IntVar(&upstreamOptions.MaxIdleConnsPerHost, "max-idle-conns-per-host", 4, "The number of idle connections kept open to each distant server")
+	flag.DurationVar(&upstreamOptions.IdleConnTimeout, "idle-conn-timeout", 90*time.Second, "How long an idle connection to a distant server is kept open")
+	flag.BoolVar(&upstreamVerify, "upstream-verify", true, "Verify the certificates of the distant servers")
+	flag.StringVar(&upstreamOptions.TLS.CAFile, "upstream-ca", "", "A file with extra certificate authorities (PEM) for the distant servers, implies -upstream-verify")
+	flag.StringVar(&upstreamOptions.TLS.MinVersion, "upstream-min-tls", "1.2", "The minimal version of TLS for the distant servers (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&upstreamOptions.TLS.Ciphers, "upstream-ciphers", "", "The cipher suites allowed with the distant servers for TLS 1.0 to 1.2, comma-separated (eg TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)")
+	flag.BoolVar(&upstreamOptions.HTTP2, "upstream-http2", true, "Use HTTP/2 with the distant servers that support it")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", 0, "How long to keep serving while /readyz fails, before shutting down on SIGTERM")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "127.0.0.1/32,::1/128", "The proxies allowed to give the IP of the client in X-Forwarded-For (comma-separated CIDRs)")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "Read the PROXY protocol header (v1 or v2) on each connection")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Serve HTTPS (and HTTP/2) with this certificate file")
+	flag.StringVar(&tlsKey, "tls-key", "", "The private key file for the HTTPS certificate")
+	flag.BoolVar(&checkOnly, "check", false, "Check the configuration, redis, the cache directory and the TLS files, and exit")
+	defineSettings(flag.CommandLine, new(settings))
+	flag.StringVar(&configFile, "config", "", "A file with one option per line (\"name value\"), the reloadable ones being read again on SIGHUP")
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	if err := loadConfigFile(); err != nil {
+		log.Fatal("Configuration: ", err)
+	}
+
+	// Logging
+	if logs != "-" {
+		f, err := os.OpenFile(logs, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal("OpenFile: ", err)
+		}
+		syscall.Dup2(int(f.Fd()), int(os.Stdout.Fd()))
+		syscall.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
+	}
+
+	if accessLogFormat != "" && accessLogFormat != "combined" && accessLogFormat != "json" {
+		log.Fatal("Invalid format for the access log: ", accessLogFormat)
+	}
+
+	// Proxies in front of the daemon
+	if err := parseTrustedProxies(); err != nil {
+		log.Fatal("Trusted proxies: ", err)
+	}
+
+	// The reloadable options, with the lists of domains
+	if err := loadSettings(); err != nil {
+		log.Fatal("Configuration: ", err)
+	}
+
+	// Admin endpoints
+	if err := parseAdminAllow(); err != nil {
+		log.Fatal("Admin networks: ", err)
+	}
+
+	// Error reporting
+	if err := setupSentry(); err != nil {
+		log.Fatal("Sentry: ", err)
+	}
+
+	// Tracing
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		log.Fatal("Tracing: ", err)
+	}
+	defer shutdownTracing()
+
+	// Redis
+	connection, err := cache.NewRedisClient(conn, redisOptions)
+	if err != nil {
+		log.Fatal("Redis: ", err)
+	}
+	defer connection.Close()
+
+	// Cache store
+	if err = checkSharding(); err != nil {
+		log.Fatal("Sharding: ", err)
+	}
+	store, err := cache.NewStore(directory, s3Endpoint, s3Region)
+	if err != nil {
+		log.Fatal("Store: ", err)
+	}
+	if sharedStore != "" {
+		shared, err := cache.NewStore(sharedStore, s3Endpoint, s3Region)
+		if err != nil {
+			log.Fatal("Shared store: ", err)
+		}
+		store = cache.NewTieredStore(store, shared, enqueue)
+	}
+
+	// Redirections to the original URLs
+	ImgBehaviour.RedirectOnError = imgRedirectOnError
+	AvatarBehaviour.RedirectOnError = avatarRedirectOnError
+
+	// Processing of the images
+	parseAllowedFormats()
+	if jpegQuality < 1 || jpegQuality > 100 {
+		log.Fatal("Invalid quality for the JPEGs: ", jpegQuality)
+	}
+	if maxQuality < 0 || maxQuality > 100 {
+		log.Fatal("Invalid maximal quality for the JPEG variants: ", maxQuality)
+	}
+	if progressiveJPEG && !progressiveSupported {
+		log.Fatal("-progressive-jpeg: ", ErrProgressiveJPEG)
+	}
+	if progressiveJPEG || pngOptimizer != "" || watermark != "" {
+		ImgBehaviour.Manipulate = processImage
+	}
+
+	// Image for the blocked content
+	if blockedStatus < 400 || blockedStatus > 599 {
+		log.Fatal("Invalid status code for the blocked images: ", blockedStatus)
+	}
+	if blockedImageFile != "" {
+		blockedImage, err = loadLocalImage(blockedImageFile)
+		if err != nil {
+			log.Fatal("Blocked image: ", err)
+		}
+	}
+
+	// Image for the broken or unavailable images
+	if unavailableImageFile != "" {
+		unavailableImage, err = loadLocalImage(unavailableImageFile)
+		if err != nil {
+			log.Fatal("Unavailable image: ", err)
+		}
+	}
+
+	// Default avatar
+	if defaultAvatarFile != "" {
+		defaultAvatar, err = loadLocalImage(defaultAvatarFile)
+		if err != nil {
+			log.Fatal("Default avatar: ", err)
+		}
+	}
+
+	// In-memory cache
+	hotCacheSize = hotCacheSizeMB << 20
+	hotCacheMaxItem = hotCacheMaxItemKB << 10
+
+	// Size of the cache
+	maxCacheSize = maxCacheSizeMB << 20
+
+	// The fetcher for the distant servers
+	upstreamOptions.TLS.InsecureSkipVerify = !upstreamVerify
+	if !upstreamOptions.TLS.Verified() {
+		log.Println("Warning: the certificates of the distant servers are not verified (-upstream-verify=false), the connections to them can be intercepted")
+	}
+	if dnsServers != "" {
+		upstreamOptions.DNSServers = strings.Split(dnsServers, ",")
+	}
+	upstreamOptions.Header = http.Header(extraHeaders)
+	upstreamOptions.CheckHost = checkHost
+	upstreamOptions.Logf = infof
+	upstream, err := fetcher.New(upstreamOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := NewServer(connection, store, keyPrefix, upstream)
+
+	// Background tasks
+	startWorkers()
+	startLoadShedding()
+
+	// The maintenance commands don't start the evictor, the GC, etc.
+	if command != "serve" {
+		code := srv.runCommand(command, flag.Args())
+		drainQueue()
+		os.Exit(code)
+	}
+	if checkOnly {
+		os.Exit(srv.runChecks(tlsCert, tlsKey))
+	}
+
+	// Cache eviction
+	srv.startEvictor()
+	srv.startGC()
+
+	// Rate limiting
+	startBucketsCleaner()
+	startCircuitsCleaner()
+
+	startReloader()
+
+	// Profiling
+	startAdminServer()
+
+	// Start the HTTP server
+	ln, err := listen(addr)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	if proxyProtocol {
+		ln = proxyListener{ln}
+	}
+	log.Printf("Listening on %s\n", addr)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           withRequestID(withAccessLog(withLoadShedding(withTracing(withRecovery(srv.Handler()))))),
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	if tlsCert != "" {
+		reloader, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatal("TLS: ", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+	}
+	sdReady()
+	startWatchdog()
+	err = serve(server, ln)
+	if err != nil {
+		log.Fatal("Serve: ", err)
+	}
+}
@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+)
+
+// Check that two durations are equal, to the second
+func sameSeconds(a, b time.Duration) bool {
+	return (a - b).Round(time.Second) == 0
+}
+
+func TestHeadersMaxAge(t *testing.T) {
+	maxAge := currentSettings().maxAge
+	var h Headers
+	if h.age() != -1 || h.maxAge() != maxAge {
+		t.Errorf("without a validation time: age = %s, maxAge = %s", h.age(), h.maxAge())
+	}
+
+	// Validated 3 hours ago, refreshed in 21 hours: fresh for max-age more
+	h.cachedAt = time.Now().Add(-3 * time.Hour)
+	h.refreshAt = h.cachedAt.Add(24 * time.Hour)
+	if got := h.maxAge() - h.age(); !sameSeconds(got, maxAge) {
+		t.Errorf("max-age - Age = %s, want %s", got, maxAge)
+	}
+
+	// Refreshed in 10 minutes: fresh until then
+	h.refreshAt = time.Now().Add(10 * time.Minute)
+	if got := h.maxAge() - h.age(); !sameSeconds(got, 10*time.Minute) {
+		t.Errorf("max-age - Age = %s, want 10m", got)
+	}
+
+	// Not refreshed in time: already stale
+	h.refreshAt = time.Now().Add(-time.Hour)
+	if !sameSeconds(h.maxAge(), h.age()) {
+		t.Errorf("max-age = %s, want the age %s", h.maxAge(), h.age())
+	}
+}
+
+func TestRedirectableError(t *testing.T) {
+	srv := setupCache(t)
+	uri := "http://a.example/1.png"
+	if !srv.redirectableError(uri, &statusError{code: 503}) || !srv.redirectableError(uri, ErrCircuitOpen) {
+		t.Errorf("a failing server is not redirected")
+	}
+	for _, err := range []error{ErrBlocked, ErrUnknownURL, ErrRedisUnavailable, ErrExceededMaxSize,
+		ErrInvalidContentType, ErrTooManyPixels, fetcher.ErrPrivateAddress, &statusError{code: 404}} {
+		if srv.redirectableError(uri, err) {
+			t.Errorf("%v is redirected", err)
+		}
+	}
+	srv.redis.HSet(srv.keyPrefix+uri, "nsfw", "1")
+	if srv.redirectableError(uri, ErrCircuitOpen) {
+		t.Errorf("a NSFW image is redirected")
+	}
+}
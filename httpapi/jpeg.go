@@ -0,0 +1,27 @@
+//go:build !libjpeg
+
+package httpapi
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// The encoder of the standard library only writes baseline JPEGs.
+// Build with -tags libjpeg (and cgo) for the progressive ones.
+const progressiveSupported = false
+
+// Decode a JPEG image with the standard library
+func decodeJPEG(body []byte) (image.Image, error) {
+	return jpeg.Decode(bytes.NewReader(body))
+}
+
+// Encode an image as a baseline JPEG with the standard library
+func writeJPEG(w io.Writer, img image.Image, quality int, progressive bool) error {
+	if progressive {
+		return ErrProgressiveJPEG
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
@@ -0,0 +1,28 @@
+//go:build libjpeg
+
+package httpapi
+
+import (
+	"bytes"
+	"image"
+	"io"
+
+	libjpeg "github.com/pixiv/go-libjpeg/jpeg"
+)
+
+// The progressive JPEGs are encoded by libjpeg, with cgo
+const progressiveSupported = true
+
+// Decode a JPEG image with libjpeg
+func decodeJPEG(body []byte) (image.Image, error) {
+	return libjpeg.Decode(bytes.NewReader(body), &libjpeg.DecoderOptions{})
+}
+
+// Encode an image as a JPEG with libjpeg
+func writeJPEG(w io.Writer, img image.Image, quality int, progressive bool) error {
+	return libjpeg.Encode(w, img, &libjpeg.EncoderOptions{
+		Quality:         quality,
+		OptimizeCoding:  true,
+		ProgressiveMode: progressive,
+	})
+}
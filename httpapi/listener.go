@@ -0,0 +1,215 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The environment variable used to give the listening socket to a new process
+const ListenFdEnv = "IMG_LISTEN_FD"
+
+// How long we wait for the pending requests before stopping
+const ShutdownTimeout = 30 * time.Second
+
+// The prefix of the address for listening on a unix domain socket
+const UnixPrefix = "unix:"
+
+// The permissions of the unix domain socket, in octal
+var socketMode string
+
+// The owner of the unix domain socket, as user or user:group
+var socketOwner string
+
+// Listen on addr (host:port or unix:/path/to/socket), or reuse the socket
+// inherited from the parent process or passed by systemd
+func listen(addr string) (net.Listener, error) {
+	str := os.Getenv(ListenFdEnv)
+	if str == "" {
+		if ln, err := systemdListener(); ln != nil || err != nil {
+			return ln, err
+		}
+		if strings.HasPrefix(addr, UnixPrefix) {
+			return listenUnix(addr[len(UnixPrefix):])
+		}
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(ListenFdEnv)
+
+	fd, err := strconv.Atoi(str)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	log.Printf("Inherit the listening socket from fd %d\n", fd)
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	// We are now in charge of removing the socket file on shutdown
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	return ln, nil
+}
+
+// Listen on a unix domain socket, with the configured permissions and owner
+func listenUnix(filename string) (net.Listener, error) {
+	// Remove the socket left by a process that has not exited cleanly
+	if stat, err := os.Lstat(filename); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(filename)
+	}
+	ln, err := net.Listen("unix", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if socketMode != "" {
+		mode, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		if err = os.Chmod(filename, os.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	if socketOwner != "" {
+		uid, gid, err := lookupOwner(socketOwner)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		if err = os.Chown(filename, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// Find the uid and gid for user or user:group
+func lookupOwner(owner string) (uid int, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		return
+	}
+	uid, _ = strconv.Atoi(u.Uid)
+	gid, _ = strconv.Atoi(u.Gid)
+	if len(parts) == 2 {
+		var g *user.Group
+		g, err = user.LookupGroup(parts[1])
+		if err != nil {
+			return
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return
+}
+
+// Start a new process of the current binary with the same arguments,
+// and give it the listening socket, so it can accept the new connections
+func upgrade(ln net.Listener) error {
+	l, ok := ln.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return errors.New("This listener can't be passed to another process")
+	}
+	f, err := l.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles[0] is the fd 3 in the child process
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), ListenFdEnv+"=3")
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started a new process with pid %d\n", cmd.Process.Pid)
+	return nil
+}
+
+// Set to 1 when the process is shutting down
+var draining int32
+
+// How long we keep accepting requests while reported as not ready,
+// when the process is asked to stop (for the load balancers)
+var shutdownDelay time.Duration
+
+// Serve HTTP requests on ln until the process is asked to stop.
+// On SIGUSR2, a new process is started with the same listening socket and
+// this one finishes the pending requests before exiting (zero-downtime
+// restart). On SIGINT and SIGTERM, the pending requests are finished too.
+func serve(server *http.Server, ln net.Listener) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+		for sig := range signals {
+			if sig == syscall.SIGUSR2 {
+				if err := upgrade(ln); err != nil {
+					log.Printf("Error while upgrading: %s\n", err)
+					continue
+				}
+				// The new process is still using the socket file
+				if ul, ok := ln.(*net.UnixListener); ok {
+					ul.SetUnlinkOnClose(false)
+				}
+			} else if shutdownDelay > 0 {
+				// Let the load balancers see that we are not ready anymore
+				// before closing the listener
+				atomic.StoreInt32(&draining, 1)
+				log.Printf("Draining for %s\n", shutdownDelay)
+				time.Sleep(shutdownDelay)
+			}
+			break
+		}
+		atomic.StoreInt32(&draining, 1)
+		sdNotify("STOPPING=1")
+		log.Printf("Shutting down\n")
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error while shutting down: %s\n", err)
+		}
+	}()
+
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,40 @@
+package httpapi
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+// Use an embedded database and a temporary directory as the cache
+// for the duration of the test
+func setupCache(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	client, err := cache.NewBoltClient(filepath.Join(dir, "redis.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cache.NewStore(filepath.Join(dir, "cache"), "", "")
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return NewServer(client, s, "img/", nil)
+}
+
+// The value of a redis string, as an integer
+func redisInt(t *testing.T, srv *Server, key string) int64 {
+	t.Helper()
+	get := srv.redis.Get(srv.keyPrefix + key)
+	if get.Err() != nil {
+		return 0
+	}
+	n, err := get.Int64()
+	if err != nil {
+		t.Fatalf("%s: %s", key, err)
+	}
+	return n
+}
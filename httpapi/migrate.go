@@ -0,0 +1,184 @@
+package httpapi
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+	redis "gopkg.in/redis.v3"
+)
+
+// The key in redis for the progress of the migration of the cache, so an
+// interrupted migration can be resumed
+const MigrationKey = "migration/cursor"
+
+// The counters of a migration of the cache
+type migrationStats struct {
+	copied  int
+	skipped int
+	missing int
+	errors  int
+}
+
+// Print the progress of a migration
+func (m migrationStats) String() string {
+	return fmt.Sprintf("%d copied, %d already there, %d missing, %d errors", m.copied, m.skipped, m.missing, m.errors)
+}
+
+// Run the migrate-cache command: copy the cached files from a directory
+// with a layout (depth and hash) to a directory with another layout
+func migrateCacheCommand(args []string) int {
+	var from, to, conn, fromHash string
+	var fromDepth int
+	var restart bool
+	var redisOptions cache.RedisOptions
+	// The server has no fetcher: the images are only copied
+	srv := new(Server)
+	fs := flag.NewFlagSet("migrate-cache", flag.ExitOnError)
+	fs.StringVar(&from, "from", "", "The directory of the cache to migrate")
+	fs.StringVar(&to, "to", "", "The directory of the migrated cache (can be the same)")
+	fs.IntVar(&fromDepth, "from-depth", LegacyShardDepth, "The number of levels of directories of the cache to migrate")
+	fs.StringVar(&fromHash, "from-hash", LegacyShardHash, "The hash of the URLs in the cache to migrate (sha1 or sha256)")
+	fs.IntVar(&shardDepth, "shard-depth", LegacyShardDepth, "The number of levels of directories of the migrated cache")
+	fs.StringVar(&shardHash, "shard-hash", LegacyShardHash, "The hash of the URLs in the migrated cache (sha1 or sha256)")
+	fs.StringVar(&conn, "r", "localhost:6379/0", "The redis database of the cache")
+	fs.StringVar(&srv.keyPrefix, "redis-prefix", "img/", "The prefix for the keys in redis")
+	fs.BoolVar(&redisOptions.Cluster, "redis-cluster", false, "Use a redis cluster (refused, as SCAN doesn't reach all its nodes)")
+	fs.StringVar(&redisOptions.SentinelMaster, "redis-sentinel", "", "The name of the master for redis sentinel (the hosts in -r are then the sentinels)")
+	fs.BoolVar(&restart, "restart", false, "Start again from the beginning, instead of resuming an interrupted migration")
+	fs.Parse(args)
+
+	if from == "" || to == "" {
+		fmt.Fprintln(os.Stderr, "Usage: img-LinuxFr.org migrate-cache -from OLDDIR -to NEWDIR [options]")
+		fs.PrintDefaults()
+		return 2
+	}
+	if err := checkSharding(); err != nil {
+		fmt.Fprintln(os.Stderr, "Sharding:", err)
+		return 1
+	}
+	if from == to && fromDepth == shardDepth && fromHash == shardHash {
+		fmt.Fprintln(os.Stderr, "Nothing to migrate: same directory and same layout")
+		return 1
+	}
+
+	var err error
+	srv.redis, err = cache.NewRedisClient(conn, redisOptions)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Redis:", err)
+		return 1
+	}
+	defer srv.redis.Close()
+	if err = srv.checkScan(); err != nil {
+		fmt.Fprintln(os.Stderr, "Redis:", err)
+		return 1
+	}
+	src, err := cache.NewStore(from, "", "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Store:", err)
+		return 1
+	}
+	if srv.store, err = cache.NewStore(to, "", ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Store:", err)
+		return 1
+	}
+	if _, ok := srv.store.(cache.Chtimer); !ok {
+		fmt.Fprintln(os.Stderr, "Warning: the mtimes can't be kept in", to, "so the images will have a new Last-Modified")
+	}
+
+	var cursor int64
+	if get := srv.redis.Get(srv.keyPrefix + MigrationKey); get.Err() == nil && !restart {
+		cursor, _ = strconv.ParseInt(get.Val(), 10, 64)
+		fmt.Printf("Resuming the migration at cursor %d\n", cursor)
+	}
+	var stats migrationStats
+	for {
+		var keys []string
+		cursor, keys, err = srv.redis.Scan(cursor, srv.keyPrefix+"*", GCScanCount).Result()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Redis:", err)
+			return 1
+		}
+		for _, key := range keys {
+			if uri := strings.TrimPrefix(key, srv.keyPrefix); srv.cachedURL(key, uri) {
+				srv.migrateImage(src, uri, from == to, fromHash, fromDepth, &stats)
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+		srv.redis.Set(srv.keyPrefix+MigrationKey, strconv.FormatInt(cursor, 10), 0)
+		fmt.Printf("Migrating: %s\n", stats)
+	}
+	srv.redis.Del(srv.keyPrefix + MigrationKey)
+	fmt.Printf("Migration done: %s\n", stats)
+	if stats.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Check if a key in redis is the hash of a cached image
+func (srv *Server) cachedURL(key, uri string) bool {
+	for _, prefix := range gcSkippedPrefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return false
+		}
+	}
+	hexists := srv.redis.HExists(key, "type")
+	return hexists.Err() == nil && hexists.Val()
+}
+
+// Copy the cached file of an image from src to the store, with the new
+// layout, and its mtime, as it gives the Last-Modified of the image.
+// The file is removed from src if the migration is in place.
+// The blobs of dedup don't depend on the layout, they are only copied to
+// the new directory. The variants are not migrated: they are made again
+// when they are requested.
+func (srv *Server) migrateImage(src cache.Store, uri string, inPlace bool, fromHash string, fromDepth int, stats *migrationStats) {
+	oldKey, newKey := shardedKey(uri, fromHash, fromDepth), generateKeyForCache(uri)
+	if hget := srv.redis.HGet(srv.keyPrefix+uri, "blob"); hget.Err() == nil && hget.Val() != "" {
+		if inPlace {
+			stats.skipped++
+			return
+		}
+		oldKey, newKey = blobKey(hget.Val()), blobKey(hget.Val())
+	} else if hget.Err() != nil && hget.Err() != redis.Nil {
+		stats.errors++
+		return
+	}
+
+	if _, err := srv.store.Stat(newKey); err == nil {
+		stats.skipped++
+		return
+	}
+	body, modTime, err := src.Open(oldKey)
+	if os.IsNotExist(err) {
+		stats.missing++
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while reading %s: %s\n", uri, err)
+		stats.errors++
+		return
+	}
+	err = srv.store.Put(newKey, body)
+	body.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error while writing %s: %s\n", uri, err)
+		stats.errors++
+		return
+	}
+	if chtimer, ok := srv.store.(cache.Chtimer); ok {
+		if err = chtimer.Chtimes(newKey, modTime); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while keeping the mtime of %s: %s\n", uri, err)
+		}
+	}
+	if inPlace {
+		src.Delete(oldKey)
+	}
+	stats.copied++
+}
@@ -0,0 +1,42 @@
+package httpapi
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+func TestMigrateImageKeepsModTime(t *testing.T) {
+	srv := setupCache(t)
+	defer func(depth int, hash string) { shardDepth, shardHash = depth, hash }(shardDepth, shardHash)
+	src, err := cache.NewStore(filepath.Join(t.TempDir(), "old"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "http://a.example/1.png"
+	oldKey := shardedKey(uri, LegacyShardHash, LegacyShardDepth)
+	if err = src.Put(oldKey, strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	src.(cache.Chtimer).Chtimes(oldKey, modTime)
+	srv.redis.HSet(srv.keyPrefix+uri, "type", "image/png")
+
+	shardDepth, shardHash = 2, "sha256"
+	var stats migrationStats
+	srv.migrateImage(src, uri, false, LegacyShardHash, LegacyShardDepth, &stats)
+	if stats.copied != 1 {
+		t.Fatalf("migration: %s", stats)
+	}
+	mtime, err := srv.store.Stat(generateKeyForCache(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mtime.Equal(modTime) {
+		t.Errorf("mtime = %s, want %s", mtime, modTime)
+	}
+}
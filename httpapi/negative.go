@@ -0,0 +1,191 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+)
+
+// Serve the last cached copy of the images gone from their server
+var serveGone bool
+
+// How long the errors are cached, by class (see errorClass)
+var errorTTLs = durationsFlag{}
+
+// durationsFlag is a flag that can be repeated to give a duration per class
+type durationsFlag map[string]time.Duration
+
+// String is used by the flag package to display the durations
+func (d durationsFlag) String() string {
+	var pairs []string
+	for class, duration := range d {
+		pairs = append(pairs, class+"="+duration.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds durations given as "class=duration", comma-separated
+func (d durationsFlag) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("Invalid error TTL, expected class=duration")
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return err
+		}
+		d[strings.TrimSpace(parts[0])] = duration
+	}
+	return nil
+}
+
+// statusError is the error for an unexpected status code from the server
+type statusError struct {
+	code int
+}
+
+// Error keeps the same message for all the status codes
+func (e *statusError) Error() string {
+	return "Unexpected status code"
+}
+
+// cachedError is an error saved in redis by saveErrorInCache, and found
+// when the image is requested again. It is saved as "class: message".
+type cachedError struct {
+	class   string
+	message string
+}
+
+// Error gives the message of the original error
+func (e *cachedError) Error() string {
+	return e.message
+}
+
+// The value saved in redis for an error
+func errorValue(err error) string {
+	if classes := errorClasses(err); len(classes) > 0 {
+		return classes[0] + ": " + err.Error()
+	}
+	return err.Error()
+}
+
+// Parse an error saved in redis. The errors saved before their class was
+// kept have only a message.
+func parseCachedError(value string) *cachedError {
+	parts := strings.SplitN(value, ": ", 2)
+	if len(parts) == 2 && !strings.Contains(parts[0], " ") {
+		return &cachedError{parts[0], parts[1]}
+	}
+	return &cachedError{"", value}
+}
+
+// Check if an error is transient (network, timeout, 429, 5xx, a host that is
+// failing or asked us to slow down, or too many fetches in progress), and the
+// image may be available if the client retries later
+func transientError(err error) bool {
+	if err == ErrCircuitOpen || err == ErrHostBackoff || err == ErrOverloaded {
+		return true
+	}
+	classes := errorClasses(err)
+	if e, ok := err.(*cachedError); ok {
+		classes = []string{e.class}
+	}
+	for _, class := range classes {
+		if class == "network" || class == "timeout" || class == "429" || strings.HasPrefix(class, "5") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if an error says that the image is gone forever from its server:
+// a 404 or 410 status code
+func goneError(err error) bool {
+	classes := errorClasses(err)
+	if e, ok := err.(*cachedError); ok {
+		classes = []string{e.class}
+	}
+	for _, class := range classes {
+		if class == "404" || class == "410" {
+			return true
+		}
+	}
+	return false
+}
+
+// How long the client should wait before retrying after a transient error:
+// the remaining time before the error expires from the cache
+func (srv *Server) retryAfter(uri string, err error) time.Duration {
+	if err == ErrCircuitOpen {
+		return breakerCooldown
+	}
+	if err == ErrHostBackoff {
+		return srv.backoffRemaining(uri)
+	}
+	if err == ErrOverloaded {
+		return OverloadRetryAfter
+	}
+	if _, ok := err.(*cachedError); ok {
+		if ttl := srv.redis.TTL(srv.keyPrefix + "err/" + uri); ttl.Err() == nil && ttl.Val() > 0 {
+			return ttl.Val()
+		}
+	}
+	return errorDuration(err)
+}
+
+// The classes of an error, from the most specific to the most generic:
+// the status code (404) and its family (4xx), network, timeout, pixels, size,
+// type, private, redirect or blocked
+func errorClasses(err error) []string {
+	if errors.Is(err, fetcher.ErrPrivateAddress) {
+		return []string{"private"}
+	}
+	// The redirects that are refused come wrapped in a *url.Error, which is
+	// also a net.Error: they must not be taken for network errors
+	if errors.Is(err, ErrBlockedDomain) {
+		return []string{"blocked"}
+	}
+	if errors.Is(err, fetcher.ErrTooManyRedirects) || errors.Is(err, fetcher.ErrInsecureRedirect) ||
+		errors.Is(err, fetcher.ErrInvalidRedirect) {
+		return []string{"redirect"}
+	}
+	switch e := err.(type) {
+	case *statusError:
+		return []string{strconv.Itoa(e.code), fmt.Sprintf("%dxx", e.code/100)}
+	case net.Error:
+		if e.Timeout() {
+			return []string{"timeout", "network"}
+		}
+		return []string{"network"}
+	}
+	switch err {
+	case ErrExceededMaxSize:
+		return []string{"size"}
+	case ErrInvalidContentType:
+		return []string{"type"}
+	case ErrTooManyPixels:
+		return []string{"pixels", "size"}
+	}
+	return nil
+}
+
+// How long err must be cached
+func errorDuration(err error) time.Duration {
+	for _, class := range errorClasses(err) {
+		if duration, ok := errorTTLs[class]; ok {
+			return duration
+		}
+	}
+	if goneError(err) {
+		return currentSettings().goneTTL
+	}
+	return currentSettings().errorTTL
+}
@@ -0,0 +1,47 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+)
+
+// An error of the HTTP client, as returned for a request on a distant server
+func clientError(err error) error {
+	return &url.Error{Op: "Get", URL: "http://example.com/a.png", Err: err}
+}
+
+func TestErrorClasses(t *testing.T) {
+	dialError := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		err       error
+		classes   []string
+		transient bool
+	}{
+		{&statusError{code: 404}, []string{"404", "4xx"}, false},
+		{&statusError{code: 503}, []string{"503", "5xx"}, true},
+		{clientError(dialError), []string{"network"}, true},
+		{clientError(context.DeadlineExceeded), []string{"timeout", "network"}, true},
+		{clientError(&net.OpError{Op: "dial", Net: "tcp", Err: fetcher.ErrPrivateAddress}), []string{"private"}, false},
+		{clientError(fetcher.ErrTooManyRedirects), []string{"redirect"}, false},
+		{clientError(fetcher.ErrInsecureRedirect), []string{"redirect"}, false},
+		{clientError(errors.Join(fetcher.ErrInvalidRedirect, errors.New("Invalid scheme"))), []string{"redirect"}, false},
+		{clientError(ErrBlockedDomain), []string{"blocked"}, false},
+		{ErrExceededMaxSize, []string{"size"}, false},
+		{ErrInvalidContentType, []string{"type"}, false},
+		{ErrTooManyPixels, []string{"pixels", "size"}, false},
+	}
+	for _, test := range tests {
+		if classes := errorClasses(test.err); !reflect.DeepEqual(classes, test.classes) {
+			t.Errorf("errorClasses(%v) = %v, want %v", test.err, classes, test.classes)
+		}
+		if transientError(test.err) != test.transient {
+			t.Errorf("transientError(%v) = %v, want %v", test.err, !test.transient, test.transient)
+		}
+	}
+}
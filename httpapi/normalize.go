@@ -0,0 +1,158 @@
+package httpapi
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+)
+
+// The fields of the hash of an image that are set by the main site (or by
+// the moderators), and not by the daemon
+var siteFields = []string{"created_at", "status", "nsfw"}
+
+// How long an URL is not checked again by migrateURL after a check: a block
+// on the old URL is copied with this delay at most
+const MigrationCheckInterval = 1 * time.Minute
+
+// The maximal number of URLs remembered as checked by migrateURL
+const MigrationEntries = 10000
+
+// The URLs that are not normalized and have been checked recently by
+// migrateURL, with the time of the check, so the requests for them don't
+// cost some redis round trips each time
+var migrationChecks = struct {
+	sync.Mutex
+	checkedAt map[string]time.Time
+}{checkedAt: make(map[string]time.Time)}
+
+// Normalize an URL, so the different spellings of the same URL share the same
+// entry in the cache: the scheme and the host are lowercased, the default
+// port and the fragment are removed, and the dot-segments of the path are
+// resolved.
+func normalizeURL(u *url.URL) string {
+	n := *u
+	n.Scheme = strings.ToLower(u.Scheme)
+	n.Host = strings.ToLower(u.Host)
+	port := u.Port()
+	if (n.Scheme == "http" && port == "80") || (n.Scheme == "https" && port == "443") {
+		n.Host = strings.TrimSuffix(n.Host, ":"+port)
+	}
+	n.Fragment = ""
+	n.RawFragment = ""
+
+	escaped := removeDotSegments(u.EscapedPath())
+	if escaped == "" {
+		escaped = "/"
+	}
+	if path, err := url.PathUnescape(escaped); err == nil {
+		n.Path = path
+		n.RawPath = escaped
+	}
+	return n.String()
+}
+
+// Resolve the . and .. segments of a path, as in RFC 3986
+func removeDotSegments(path string) string {
+	segments := strings.Split(path, "/")
+	var out []string
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, segment)
+			continue
+		}
+		// The path still ends with a slash after a trailing . or ..
+		if last {
+			out = append(out, "")
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// Parse an URL, check that it is an http(s) URL, and normalize it
+func (srv *Server) parseImageURL(uri string) (normalized string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	if err = fetcher.ValidateURL(u); err != nil {
+		return
+	}
+	normalized = normalizeURL(u)
+	if normalized != uri && migrationDue(uri) {
+		srv.migrateURL(uri, normalized)
+	}
+	return
+}
+
+// Tell if the migration of uri must be checked, i.e. it has not been checked
+// in the last MigrationCheckInterval, and remember that it is checked now
+func migrationDue(uri string) bool {
+	migrationChecks.Lock()
+	defer migrationChecks.Unlock()
+	now := time.Now()
+	checkedAt, ok := migrationChecks.checkedAt[uri]
+	if ok && now.Sub(checkedAt) < MigrationCheckInterval {
+		return false
+	}
+	if !ok && len(migrationChecks.checkedAt) >= MigrationEntries {
+		// The map is full: drop a random entry
+		for other := range migrationChecks.checkedAt {
+			delete(migrationChecks.checkedAt, other)
+			break
+		}
+	}
+	migrationChecks.checkedAt[uri] = now
+	return true
+}
+
+// The main site creates the hash of an image with the URL as it was written
+// in a content, and the entries cached before the normalization use it too.
+// The fields of the main site are copied once to the hash of the normalized
+// URL, without overwriting the ones it already has (a moderator may have
+// changed them since), and the image cached under the old URL is evicted.
+// Only a block on the old URL is copied again later, as it can't undo any
+// moderation.
+func (srv *Server) migrateURL(old, normalized string) {
+	hexists := srv.redis.HExists(srv.keyPrefix+old, "created_at")
+	if hexists.Err() != nil || !hexists.Val() {
+		return
+	}
+	hexists = srv.redis.HExists(srv.keyPrefix+old, "migrated")
+	if hexists.Err() != nil {
+		return
+	}
+	if hexists.Val() {
+		hget := srv.redis.HGet(srv.keyPrefix+old, "status")
+		if hget.Err() == nil && hget.Val() == "Blocked" {
+			if status := srv.redis.HGet(srv.keyPrefix+normalized, "status"); status.Val() != "Blocked" {
+				srv.redis.HSet(srv.keyPrefix+normalized, "status", "Blocked")
+			}
+		}
+		return
+	}
+
+	for _, field := range siteFields {
+		hget := srv.redis.HGet(srv.keyPrefix+old, field)
+		if hget.Err() != nil {
+			continue
+		}
+		if exists := srv.redis.HExists(srv.keyPrefix+normalized, field); exists.Err() == nil && !exists.Val() {
+			srv.redis.HSet(srv.keyPrefix+normalized, field, hget.Val())
+		}
+	}
+	hexists = srv.redis.HExists(srv.keyPrefix+old, "type")
+	if hexists.Err() == nil && hexists.Val() {
+		srv.deleteFromCache(old)
+	}
+	srv.redis.HSet(srv.keyPrefix+old, "migrated", "1")
+}
@@ -0,0 +1,56 @@
+package httpapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMigrateURL(t *testing.T) {
+	srv := setupCache(t)
+	old, normalized := "HTTP://Example.com:80/a.png", "http://example.com/a.png"
+	srv.redis.HSet(srv.keyPrefix+old, "created_at", "1")
+	srv.redis.HSet(srv.keyPrefix+old, "nsfw", "1")
+
+	if uri, err := srv.parseImageURL(old); err != nil || uri != normalized {
+		t.Fatalf("parseImageURL = %s, %v", uri, err)
+	}
+	if hget := srv.redis.HGet(srv.keyPrefix+normalized, "created_at"); hget.Val() != "1" {
+		t.Errorf("created_at is not copied")
+	}
+	if hexists := srv.redis.HExists(srv.keyPrefix+normalized, "nsfw"); !hexists.Val() {
+		t.Errorf("nsfw is not copied")
+	}
+
+	// A moderator unblurs the image: the next requests don't revert it
+	srv.redis.HDel(srv.keyPrefix+normalized, "nsfw")
+	srv.parseImageURL(old)
+	if hexists := srv.redis.HExists(srv.keyPrefix+normalized, "nsfw"); hexists.Val() {
+		t.Errorf("the moderation has been reverted")
+	}
+
+	// But the image is blocked when the main site blocks the old URL, at
+	// the next check of the migration
+	srv.redis.HSet(srv.keyPrefix+old, "status", "Blocked")
+	srv.parseImageURL(old)
+	if hget := srv.redis.HGet(srv.keyPrefix+normalized, "status"); hget.Val() == "Blocked" {
+		t.Errorf("the migration is checked on each request")
+	}
+	migrationChecks.Lock()
+	migrationChecks.checkedAt[old] = time.Now().Add(-MigrationCheckInterval)
+	migrationChecks.Unlock()
+	srv.parseImageURL(old)
+	if hget := srv.redis.HGet(srv.keyPrefix+normalized, "status"); hget.Val() != "Blocked" {
+		t.Errorf("the block is not copied")
+	}
+}
+
+func TestMigrateUnknownURL(t *testing.T) {
+	srv := setupCache(t)
+	srv.parseImageURL("HTTP://Example.com/unknown.png")
+	if exists := srv.redis.Exists(srv.keyPrefix + "HTTP://Example.com/unknown.png"); exists.Val() {
+		t.Errorf("a hash is created for an unknown URL")
+	}
+	if exists := srv.redis.Exists(srv.keyPrefix + "http://example.com/unknown.png"); exists.Val() {
+		t.Errorf("a hash is created for the normalized unknown URL")
+	}
+}
@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// The images flagged as NSFW are shrunk to this width, and enlarged again,
+// to blur them
+const BlurWidth = 16
+
+// The maximal width of the blurred variants, in pixels
+const BlurMaxWidth = 640
+
+// Check if the client asked for the original of a NSFW image
+func unblurred(r *http.Request) bool {
+	return r.URL.Query().Get("unblur") == "1"
+}
+
+// Blur an image, and encode it as a JPEG
+func blurImage(body []byte) ([]byte, error) {
+	img, _, err := decodeImage(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	width := uint(img.Bounds().Dx())
+	if width > BlurMaxWidth {
+		width = BlurMaxWidth
+	}
+	small := resize.Resize(BlurWidth, 0, img, resize.Bilinear)
+	blurred := resize.Resize(width, 0, small, resize.Bilinear)
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, blurred, &jpeg.Options{Quality: 70}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Give the blurred variant of an image flagged as NSFW by the moderators.
+// The images that can't be blurred (SVG for example) are not served.
+func (srv *Server) blurredVariant(ctx context.Context, uri string, headers *Headers, body io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	variant, err := srv.cachedVariant(ctx, uri, BlurSuffix, headers, body, blurImage)
+	body.Close()
+	if err != nil {
+		logf(ctx, "Error while blurring %s: %s\n", uri, err)
+		return nil, err
+	}
+	headers.contentType = "image/jpeg"
+	if headers.etag != "" {
+		headers.etag = strings.TrimSuffix(headers.etag, `"`) + "-blur" + `"`
+	}
+	return variant, nil
+}
+
+// Receive an HTTP request to flag an image as NSFW: it is then blurred,
+// except with ?unblur=1
+func (srv *Server) Blur(w http.ResponseWriter, r *http.Request) {
+	uri, ok := srv.formURL(w, r)
+	if !ok {
+		return
+	}
+	logf(r.Context(), "Blur %s\n", uri)
+	srv.redis.HSet(srv.keyPrefix+uri, "nsfw", "1")
+	removeHotImage(uri)
+	forgetImage(uri)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Receive an HTTP request to remove the NSFW flag of an image
+func (srv *Server) Unblur(w http.ResponseWriter, r *http.Request) {
+	uri, ok := srv.formURL(w, r)
+	if !ok {
+		return
+	}
+	logf(r.Context(), "Unblur %s\n", uri)
+	srv.redis.HDel(srv.keyPrefix+uri, "nsfw")
+	removeHotImage(uri)
+	forgetImage(uri)
+	w.WriteHeader(http.StatusNoContent)
+}
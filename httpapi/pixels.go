@@ -0,0 +1,64 @@
+package httpapi
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+)
+
+// The maximal width of an image, in pixels (0 for no limit)
+var maxWidth int
+
+// The maximal height of an image, in pixels (0 for no limit)
+var maxHeight int
+
+// The maximal number of pixels of an image, in millions (0 for no limit)
+var maxMegapixels float64
+
+// How many bytes are read to find the dimensions of an image: the JPEG files
+// can have large EXIF and ICC segments before them
+const HeaderLen = 256 << 10
+
+// The error when an image has too many pixels, to protect us from the
+// decompression bombs (a small file that needs gigabytes once decoded)
+var ErrTooManyPixels = errors.New("Too many pixels")
+
+// Check the dimensions of an image against the limits
+func checkDimensions(config image.Config) error {
+	if maxWidth > 0 && config.Width > maxWidth {
+		return ErrTooManyPixels
+	}
+	if maxHeight > 0 && config.Height > maxHeight {
+		return ErrTooManyPixels
+	}
+	if maxMegapixels > 0 && float64(config.Width)*float64(config.Height) > maxMegapixels*1e6 {
+		return ErrTooManyPixels
+	}
+	return nil
+}
+
+// Check the dimensions given by the header of an image. The formats that Go
+// can't parse (SVG, WebP, etc.) are accepted.
+func checkImageHeader(head []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		return nil
+	}
+	return checkDimensions(config)
+}
+
+// Decode an image, after checking its dimensions
+func decodeImage(body io.ReadSeeker) (img image.Image, format string, err error) {
+	config, _, err := image.DecodeConfig(body)
+	if err != nil {
+		return
+	}
+	if err = checkDimensions(config); err != nil {
+		return
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	return image.Decode(body)
+}
@@ -0,0 +1,68 @@
+package httpapi
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/nfnt/resize"
+	redis "gopkg.in/redis.v3"
+)
+
+// Compute the placeholders of the images when they are cached
+var placeholders bool
+
+// The width of the blurred thumbnail used as a placeholder, in pixels
+const PlaceholderWidth = 16
+
+// The width of the thumbnail used for computing the BlurHash, in pixels
+const BlurHashWidth = 32
+
+// The number of components of the BlurHash, horizontally and vertically
+const BlurHashX, BlurHashY = 4, 3
+
+// Compute the placeholders of an image, a tiny JPEG and a BlurHash, and save
+// them in redis
+func (srv *Server) savePlaceholders(uri string, img image.Image) {
+	thumb := resize.Resize(PlaceholderWidth, 0, img, resize.Bilinear)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 50}); err == nil {
+		srv.redis.HSet(srv.keyPrefix+uri, "placeholder", buf.String())
+	}
+
+	small := resize.Resize(BlurHashWidth, 0, img, resize.Bilinear)
+	if hash, err := blurhash.Encode(BlurHashX, BlurHashY, small); err == nil {
+		srv.redis.HSet(srv.keyPrefix+uri, "blurhash", hash)
+	}
+}
+
+// Respond with the placeholder of a cached image, to display while the image
+// is loading: a tiny blurred JPEG, or its BlurHash with ?format=blurhash
+func (srv *Server) Placeholder(w http.ResponseWriter, r *http.Request) {
+	uri, err := srv.decodeURL(r)
+	if err != nil {
+		http.Error(w, "Invalid parameters", 400)
+		return
+	}
+
+	field, contentType := "placeholder", "image/jpeg"
+	if r.URL.Query().Get("format") == "blurhash" {
+		field, contentType = "blurhash", "text/plain; charset=utf-8"
+	}
+	hget := srv.redis.HGet(srv.keyPrefix+uri, field)
+	if hget.Err() == redis.Nil {
+		srv.analyzeCachedImage(uri)
+		hget = srv.redis.HGet(srv.keyPrefix+uri, field)
+	}
+	if hget.Err() != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	setCORSHeaders(w, r)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", publicCacheControl(currentSettings().maxAge))
+	w.Write([]byte(hget.Val()))
+}
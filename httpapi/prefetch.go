@@ -0,0 +1,171 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The maximal number of URLs in a batch of prefetches
+const MaxPrefetchBatch = 10000
+
+// How long the state of a finished job is kept
+const PrefetchJobTTL = 1 * time.Hour
+
+// How many images of the jobs are prefetched at the same time. The jobs
+// don't use the queue of the workers, so they can't fill it.
+const PrefetchJobConcurrency = 4
+
+// The slots for the prefetches of the jobs, shared by all the jobs
+var prefetchJobSlots = make(chan struct{}, PrefetchJobConcurrency)
+
+// A batch of prefetches, and its progress
+type prefetchJob struct {
+	mu     sync.Mutex
+	ID     string `json:"id"`
+	Total  int    `json:"total"`
+	Done   int    `json:"done"`
+	Failed int    `json:"failed"`
+}
+
+// The jobs of batch prefetches, by ID
+var prefetchJobs = struct {
+	sync.Mutex
+	m map[string]*prefetchJob
+}{m: make(map[string]*prefetchJob)}
+
+// Fetch and cache an image that is not in the cache yet
+func (srv *Server) prefetchImage(ctx context.Context, uri string) error {
+	if err := srv.urlStatus(uri); err != nil {
+		logf(ctx, "Can't prefetch %s: %s\n", uri, err)
+		return err
+	}
+	return srv.refreshImage(ctx, uri, imgBehaviour())
+}
+
+// Read the URL to prefetch from the url form value,
+// or from its hexadecimal encoding in encoded_url
+func (srv *Server) prefetchURL(r *http.Request) (uri string, err error) {
+	uri = r.FormValue("url")
+	if uri == "" {
+		var chars []byte
+		chars, err = hex.DecodeString(r.FormValue("encoded_url"))
+		if err != nil {
+			return
+		}
+		uri = string(chars)
+	}
+	return srv.parseImageURL(uri)
+}
+
+// Read a JSON array of URLs to prefetch, without the duplicates
+func (srv *Server) prefetchURLs(w http.ResponseWriter, r *http.Request) (uris []string, err error) {
+	var all []string
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&all); err != nil {
+		return
+	}
+	seen := make(map[string]bool, len(all))
+	for _, uri := range all {
+		if uri, err = srv.parseImageURL(uri); err != nil {
+			return
+		}
+		if seen[uri] {
+			continue
+		}
+		seen[uri] = true
+		uris = append(uris, uri)
+	}
+	return
+}
+
+// Create a job for prefetching uris, and run it in the background
+func (srv *Server) startPrefetchJob(ctx context.Context, uris []string) *prefetchJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &prefetchJob{ID: hex.EncodeToString(id), Total: len(uris)}
+	prefetchJobs.Lock()
+	prefetchJobs.m[job.ID] = job
+	prefetchJobs.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(uris))
+	go func() {
+		for _, uri := range uris {
+			uri := uri
+			prefetchJobSlots <- struct{}{}
+			go func() {
+				defer func() { <-prefetchJobSlots }()
+				defer wg.Done()
+				err := srv.prefetchImage(ctx, uri)
+				job.mu.Lock()
+				job.Done++
+				if err != nil {
+					job.Failed++
+				}
+				job.mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		infof(ctx, "Prefetch job %s finished (%d URLs, %d failed)\n", job.ID, job.Total, job.Failed)
+		time.AfterFunc(PrefetchJobTTL, func() {
+			prefetchJobs.Lock()
+			delete(prefetchJobs.m, job.ID)
+			prefetchJobs.Unlock()
+		})
+	}()
+	return job
+}
+
+// Respond with the state of a job, as JSON
+func writeJob(w http.ResponseWriter, job *prefetchJob, status int) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+// Receive an HTTP request to warm the cache with an image: it is fetched
+// in the background, so the first reader won't have to wait for it.
+// With a JSON array of URLs as the body, they are prefetched in a job.
+func (srv *Server) Prefetch(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		uris, err := srv.prefetchURLs(w, r)
+		if err != nil || len(uris) > MaxPrefetchBatch {
+			http.Error(w, "Invalid parameters", 400)
+			return
+		}
+		writeJob(w, srv.startPrefetchJob(fetchContext(r), uris), http.StatusAccepted)
+		return
+	}
+
+	uri, err := srv.prefetchURL(r)
+	if err != nil {
+		http.Error(w, "Invalid parameters", 400)
+		return
+	}
+	ctx := fetchContext(r)
+	if !enqueue(func() { srv.prefetchImage(ctx, uri) }) {
+		http.Error(w, "Too many pending fetches", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Receive an HTTP request for the progress of a prefetch job
+func PrefetchJob(w http.ResponseWriter, r *http.Request) {
+	prefetchJobs.Lock()
+	job, ok := prefetchJobs.m[r.URL.Query().Get(":job")]
+	prefetchJobs.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJob(w, job, http.StatusOK)
+}
@@ -0,0 +1,41 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPrefetchJobDoesntUseTheQueue(t *testing.T) {
+	srv := setupCache(t)
+	defer func(tasks chan func()) { backgroundTasks = tasks }(backgroundTasks)
+	backgroundTasks = make(chan func(), 1)
+
+	// The URLs are unknown to redis, so they fail without being fetched
+	var uris []string
+	for i := 0; i < 3*PrefetchJobConcurrency; i++ {
+		uris = append(uris, fmt.Sprintf("http://a.example/%d.png", i))
+	}
+	job := srv.startPrefetchJob(context.Background(), uris)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job.mu.Lock()
+		done, failed := job.Done, job.Failed
+		job.mu.Unlock()
+		if done == len(uris) {
+			if failed != len(uris) {
+				t.Errorf("%d failed, want %d", failed, len(uris))
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the job is stuck: %d done on %d", done, len(uris))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := queueDepth(); n != 0 {
+		t.Errorf("%d tasks in the queue of the workers", n)
+	}
+}
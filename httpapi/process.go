@@ -0,0 +1,170 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Re-encode the baseline JPEGs as progressive ones when they are cached
+var progressiveJPEG bool
+
+// The quality of the re-encoded JPEGs (1-100)
+var jpegQuality int
+
+// The error when a progressive JPEG is asked without libjpeg
+var ErrProgressiveJPEG = errors.New("Progressive JPEGs need a build with -tags libjpeg")
+
+// The command for optimizing the PNG images, that reads the image on its
+// standard input and writes the optimized one on its standard output
+var pngOptimizer string
+
+// The maximal duration of the optimization of a PNG image
+const PNGOptimizerTimeout = 30 * time.Second
+
+// Process a normal image when it is saved in cache
+func processImage(uri string, body []byte) []byte {
+	if watermark != "" {
+		body = watermarkImage(uri, body)
+	}
+	if progressiveJPEG && isBaselineJPEG(body) {
+		body = progressiveJPEGFrom(body)
+	}
+	if pngOptimizer != "" && http.DetectContentType(body) == "image/png" {
+		body = optimizePNG(body)
+	}
+	return body
+}
+
+// Optimize a PNG image with the external command. The original is kept if
+// the command fails or if its output is not a smaller PNG image.
+func optimizePNG(body []byte) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), PNGOptimizerTimeout)
+	defer cancel()
+
+	args := strings.Fields(pngOptimizer)
+	if len(args) == 0 {
+		return body
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error while optimizing a PNG image: %s %s\n", err, strings.TrimSpace(stderr.String()))
+		return body
+	}
+	optimized := stdout.Bytes()
+	if len(optimized) == 0 || len(optimized) >= len(body) || http.DetectContentType(optimized) != "image/png" {
+		return body
+	}
+	return optimized
+}
+
+// A segment of a JPEG file, from its marker to the end of its payload
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// The segments of the header of a JPEG file, until the start of the scan
+func jpegSegments(body []byte) (segments []jpegSegment) {
+	if len(body) < 4 || body[0] != 0xFF || body[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(body) && body[i] == 0xFF; {
+		marker := body[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(body[i+2:]))
+		if length < 2 || i+2+length > len(body) {
+			return
+		}
+		segments = append(segments, jpegSegment{marker, body[i : i+2+length]})
+		if marker == 0xDA {
+			return
+		}
+		i += 2 + length
+	}
+	return
+}
+
+// Check if the body is a baseline JPEG (and not a progressive one)
+func isBaselineJPEG(body []byte) bool {
+	for _, s := range jpegSegments(body) {
+		switch s.marker {
+		case 0xC0, 0xC1:
+			return true
+		case 0xC2:
+			return false
+		}
+	}
+	return false
+}
+
+// Re-encode a JPEG as a progressive one, with the quality of jpegQuality.
+// The original is returned if it can't be decoded or if the progressive JPEG
+// is larger.
+func progressiveJPEGFrom(body []byte) []byte {
+	out, err := transcodeJPEG(body, jpegQuality, true)
+	if err != nil || len(out) >= len(body) {
+		return body
+	}
+	return out
+}
+
+// Re-encode a JPEG with the given quality
+func transcodeJPEG(body []byte, quality int, progressive bool) (out []byte, err error) {
+	if err = checkImageHeader(body); err != nil {
+		return
+	}
+	img, err := decodeJPEG(body)
+	if err != nil {
+		return
+	}
+	return encodeJPEG(img, body, quality, progressive)
+}
+
+// Check if a segment is (a chunk of) an ICC profile
+func isICCProfile(s jpegSegment) bool {
+	return s.marker == 0xE2 && bytes.HasPrefix(s.data[4:], []byte("ICC_PROFILE\x00"))
+}
+
+// Encode an image made from the original JPEG. The EXIF metadata of the
+// original are kept, for the orientation of the photos, and its ICC
+// profile, for the colors.
+func encodeJPEG(img image.Image, original []byte, quality int, progressive bool) (out []byte, err error) {
+	var buf bytes.Buffer
+	if err = writeJPEG(&buf, img, quality, progressive); err != nil {
+		return
+	}
+	if buf.Len() < 2 {
+		return nil, ErrInvalidContentType
+	}
+
+	// The APP1 (EXIF, XMP) and APP2 (ICC) segments are copied after the
+	// SOI marker and the JFIF APP0 segment, which must come first
+	encoded := buf.Bytes()
+	at := 2
+	if segments := jpegSegments(encoded); len(segments) > 0 && segments[0].marker == 0xE0 {
+		at += len(segments[0].data)
+	}
+	out = append(out, encoded[:at]...)
+	for _, s := range jpegSegments(original) {
+		if s.marker == 0xE1 || isICCProfile(s) {
+			out = append(out, s.data...)
+		}
+	}
+	out = append(out, encoded[at:]...)
+	return
+}
@@ -0,0 +1,46 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// A JPEG segment with the given marker and payload
+func testSegment(marker byte, payload string) []byte {
+	s := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(s[2:], uint16(2+len(payload)))
+	return append(s, payload...)
+}
+
+func TestEncodeJPEGKeepsMetadata(t *testing.T) {
+	exif := testSegment(0xE1, "Exif\x00\x00orientation")
+	icc := testSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile")
+	original := []byte{0xFF, 0xD8}
+	original = append(original, testSegment(0xE0, "JFIF\x00")...)
+	original = append(original, exif...)
+	original = append(original, icc...)
+	original = append(original, testSegment(0xDA, "scan")...)
+
+	out, err := encodeJPEG(image.NewGray(image.Rect(0, 0, 8, 8)), original, 80, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var markers []byte
+	for _, s := range jpegSegments(out) {
+		markers = append(markers, s.marker)
+		if s.marker == 0xE1 && !bytes.Equal(s.data, exif) {
+			t.Errorf("the EXIF segment is altered")
+		}
+		if s.marker == 0xE2 && !bytes.Equal(s.data, icc) {
+			t.Errorf("the ICC profile is altered")
+		}
+	}
+	if !bytes.Contains(markers, []byte{0xE1, 0xE2}) {
+		t.Fatalf("the EXIF and ICC segments are missing: % X", markers)
+	}
+	if i := bytes.IndexByte(markers, 0xE0); i > 0 {
+		t.Errorf("the APP0 segment is not the first one: % X", markers)
+	}
+}
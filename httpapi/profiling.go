@@ -0,0 +1,57 @@
+package httpapi
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// The address of the admin listener, for profiling (disabled if empty).
+// It must not be reachable from internet.
+var adminAddr string
+
+// The handlers of the admin listener: the full pprof suite. They are
+// protected like the admin endpoints when credentials or networks are
+// configured, else the listener is trusted to be private.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if adminToken == "" && adminBasicAuth == "" && len(adminNetworks) == 0 {
+		return mux
+	}
+	return adminOnly(mux.ServeHTTP)
+}
+
+// Start the admin listener, with the block and mutex profiles enabled.
+// During an upgrade, the address is still used by the old process, so we
+// retry until it has exited.
+func startAdminServer() {
+	if adminAddr == "" {
+		return
+	}
+	runtime.SetBlockProfileRate(int(time.Millisecond))
+	runtime.SetMutexProfileFraction(100)
+	go func() {
+		for attempt := 0; ; attempt++ {
+			ln, err := net.Listen("tcp", adminAddr)
+			if err != nil {
+				if attempt == 0 {
+					log.Printf("Admin listener on %s: %s, retrying\n", adminAddr, err)
+				}
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			log.Printf("Admin listener on %s\n", adminAddr)
+			server := &http.Server{Handler: adminHandler()}
+			log.Printf("Admin listener: %s\n", server.Serve(ln))
+			return
+		}
+	}()
+}
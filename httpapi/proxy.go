@@ -0,0 +1,211 @@
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The proxies (nginx, load balancers) that can give the IP address of the
+// client, in X-Forwarded-For (comma-separated CIDRs)
+var trustedProxies string
+
+// The parsed networks of trustedProxies
+var trustedNetworks []*net.IPNet
+
+// Read the PROXY protocol header (v1 or v2) on each connection
+var proxyProtocol bool
+
+// How long we wait for the PROXY protocol header
+const ProxyHeaderTimeout = 5 * time.Second
+
+// The signature of the PROXY protocol v2
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Parse the networks of the trusted proxies
+func parseTrustedProxies() error {
+	trustedNetworks = nil
+	for _, cidr := range strings.Split(trustedProxies, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		trustedNetworks = append(trustedNetworks, network)
+	}
+	return nil
+}
+
+// Check if the IP address is one of a trusted proxy. The requests
+// on a unix socket come from a local proxy.
+func trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	for _, network := range trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The IP address of the client. When the request comes from a trusted proxy,
+// it is the last address in X-Forwarded-For that is not a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		host = ip
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// A listener for the connections that start with a PROXY protocol header
+type proxyListener struct {
+	net.Listener
+}
+
+// Accept a connection. The header is read later, in the goroutine
+// of the connection, to not block the other ones.
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// File gives the socket of the listener, to pass it to a new process
+func (l proxyListener) File() (*os.File, error) {
+	f, ok := l.Listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.New("This listener can't be passed to another process")
+	}
+	return f.File()
+}
+
+// A connection with the address of the client from the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+// Read the PROXY protocol header, once
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+// Read the data after the header
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr is the address of the client given by the proxy
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// Parse a PROXY protocol header, v1 (text) or v2 (binary). The address is
+// nil for the connections of the proxy itself (health checks).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// Parse a PROXY protocol v2 header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command, or not TCP/UDP over IPv4/IPv6
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if length < 12 {
+			return nil, errors.New("Invalid PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if length < 36 {
+			return nil, errors.New("Invalid PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,66 @@
+package httpapi
+
+import (
+	"sync"
+	"time"
+)
+
+// How often the buckets of the idle clients are removed
+const RateLimitCleanInterval = 1 * time.Minute
+
+// A token bucket for a client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// The buckets of the clients, by IP address
+var buckets = struct {
+	sync.Mutex
+	m map[string]*tokenBucket
+}{m: make(map[string]*tokenBucket)}
+
+// Take a token in the bucket of the client, if there is one left
+func allowClient(ip string) bool {
+	s := currentSettings()
+	if s.rateLimit <= 0 {
+		return true
+	}
+	buckets.Lock()
+	defer buckets.Unlock()
+	now := time.Now()
+	b, ok := buckets.m[ip]
+	if !ok {
+		b = &tokenBucket{tokens: float64(s.rateBurst), last: now}
+		buckets.m[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.rateLimit
+	if b.tokens > float64(s.rateBurst) {
+		b.tokens = float64(s.rateBurst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Periodically remove the buckets that are full, as they are
+// the same as the new ones. The cleaner runs even without a rate limit, as
+// it can be enabled on SIGHUP.
+func startBucketsCleaner() {
+	go func() {
+		for range time.Tick(RateLimitCleanInterval) {
+			s := currentSettings()
+			buckets.Lock()
+			for ip, b := range buckets.m {
+				elapsed := time.Since(b.last).Seconds()
+				if b.tokens+elapsed*s.rateLimit >= float64(s.rateBurst) {
+					delete(buckets.m, ip)
+				}
+			}
+			buckets.Unlock()
+		}
+	}()
+}
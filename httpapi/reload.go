@@ -0,0 +1,218 @@
+package httpapi
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+)
+
+// The configuration file, with one option per line ("name value", without
+// the dash). The options given on the command-line take precedence.
+var configFile string
+
+// The options that can be changed on SIGHUP, without restarting the daemon.
+// The handlers read them with currentSettings, and a reload replaces them as
+// a whole, so a request never sees a half-reloaded configuration.
+type settings struct {
+	blockDomains      string
+	allowDomains      string
+	blockedDomainList []string
+	allowedDomainList []string
+	rateLimit         float64
+	rateBurst         int
+	maxSizeKB         int64
+	maxAvatarSizeKB   int64
+	errorTTL          time.Duration
+	goneTTL           time.Duration
+	maxAge            time.Duration
+	timeouts          fetcher.Timeouts
+	logLevel          string
+}
+
+// The levels of the logs: with warning, the routine lines are not logged
+var logLevels = map[string]bool{"info": true, "warning": true}
+
+// Define the flags of the reloadable options, stored in s
+func defineSettings(fs *flag.FlagSet, s *settings) {
+	fs.StringVar(&s.blockDomains, "block-domains", "", "The domains of the images that are refused, comma-separated (*.example.com for the subdomains) or @/path/to/file")
+	fs.StringVar(&s.allowDomains, "allow-domains", "", "The only domains of the images that are accepted, in the same format as -block-domains (all if empty)")
+	fs.Float64Var(&s.rateLimit, "rate-limit", 0, "The number of requests per second allowed for a client IP (0 for no limit)")
+	fs.IntVar(&s.rateBurst, "rate-burst", 20, "The number of requests a client IP can make in a burst")
+	fs.Int64Var(&s.maxSizeKB, "max-size", MaxSize>>10, "The maximal size of an image in KB")
+	fs.Int64Var(&s.maxAvatarSizeKB, "max-avatar-size", MaxSize>>10, "The maximal size of an avatar in KB")
+	fs.DurationVar(&s.errorTTL, "error-ttl", CacheRefreshInterval, "How long the errors on fetching an image are cached")
+	fs.DurationVar(&s.goneTTL, "gone-ttl", 24*time.Hour, "How long the images gone from their server (404 or 410) are cached as tombstones")
+	fs.DurationVar(&s.maxAge, "max-age", CacheRefreshInterval, "The max-age of the Cache-Control header sent to the clients")
+	fs.DurationVar(&s.timeouts.Connect, "connect-timeout", 10*time.Second, "The timeout for connecting to the distant servers")
+	fs.DurationVar(&s.timeouts.TLS, "tls-timeout", 10*time.Second, "The timeout for the TLS handshake with the distant servers")
+	fs.DurationVar(&s.timeouts.Header, "header-timeout", 10*time.Second, "The timeout for receiving the response headers of the distant servers")
+	fs.DurationVar(&s.timeouts.Total, "fetch-timeout", 10*time.Second, "The total timeout for fetching an image on a distant server")
+	fs.StringVar(&s.logLevel, "log-level", "info", "The level of the logs: info, or warning to skip the routine lines (fetches, retries, etc.)")
+}
+
+// Build the settings from the values of the options (the defaults are used
+// for the missing ones, and the options that are not reloadable are
+// ignored), and read the lists of domains
+func parseSettings(values map[string]string) (*settings, error) {
+	s := &settings{}
+	fs := flag.NewFlagSet("settings", flag.ContinueOnError)
+	defineSettings(fs, s)
+	for name, value := range values {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, errors.New(name + ": " + err.Error())
+		}
+	}
+	if !logLevels[s.logLevel] {
+		return nil, errors.New("log-level: Unknown level " + s.logLevel)
+	}
+	var err error
+	if s.blockDomains != "" {
+		if s.blockedDomainList, err = parseDomains(s.blockDomains); err != nil {
+			return nil, errors.New("block-domains: " + err.Error())
+		}
+	}
+	if s.allowDomains != "" {
+		if s.allowedDomainList, err = parseDomains(s.allowDomains); err != nil {
+			return nil, errors.New("allow-domains: " + err.Error())
+		}
+	}
+	return s, nil
+}
+
+// The settings used before the configuration is loaded (by the tests)
+var defaultSettings, _ = parseSettings(nil)
+
+// The current settings, a *settings
+var loadedSettings atomic.Value
+
+// Give the current settings. They must not be modified.
+func currentSettings() *settings {
+	if s, ok := loadedSettings.Load().(*settings); ok {
+		return s
+	}
+	return defaultSettings
+}
+
+// The options given on the command-line, with their values
+var commandLine map[string]string
+
+// The options that have been set on fs, with their values
+func setOptions(fs *flag.FlagSet) map[string]string {
+	options := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { options[f.Name] = f.Value.String() })
+	return options
+}
+
+// Read the options of the configuration file
+func readConfigFile(filename string) (options map[string]string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	options = make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		name := strings.TrimLeft(fields[0], "-")
+		if flag.Lookup(name) == nil {
+			return nil, errors.New("Unknown option in the configuration file: " + name)
+		}
+		if len(fields) == 1 {
+			options[name] = "true"
+		} else {
+			options[name] = strings.TrimSpace(fields[1])
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// Load the configuration file at startup, for the options that are not
+// given on the command-line
+func loadConfigFile() error {
+	commandLine = setOptions(flag.CommandLine)
+	if configFile == "" {
+		return nil
+	}
+	options, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	for name, value := range options {
+		if _, given := commandLine[name]; given {
+			continue
+		}
+		if err = flag.Set(name, value); err != nil {
+			return errors.New(name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Build the settings from the options of the command-line and of the
+// configuration file, once they have been loaded
+func loadSettings() error {
+	s, err := parseSettings(setOptions(flag.CommandLine))
+	if err != nil {
+		return err
+	}
+	loadedSettings.Store(s)
+	return nil
+}
+
+// Read the configuration file again, and replace the settings. The lists of
+// domains read from files (@/path/to/file) are read again too. Nothing is
+// changed if an option or a list is invalid.
+func reloadConfig() error {
+	values := make(map[string]string)
+	if configFile != "" {
+		options, err := readConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+		values = options
+	}
+	for name, value := range commandLine {
+		values[name] = value
+	}
+	s, err := parseSettings(values)
+	if err != nil {
+		return err
+	}
+	loadedSettings.Store(s)
+	return nil
+}
+
+// Reload the configuration on SIGHUP. The listeners and the cache are not
+// touched.
+func startReloader() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := reloadConfig(); err != nil {
+				log.Printf("Error while reloading the configuration: %s\n", err)
+				continue
+			}
+			log.Printf("Configuration reloaded\n")
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+package httpapi
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a configuration file and reload it
+func reloadTestConfig(t *testing.T, content string) error {
+	t.Helper()
+	configFile = filepath.Join(t.TempDir(), "img.conf")
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return reloadConfig()
+}
+
+func TestReloadConfig(t *testing.T) {
+	if flag.Lookup("max-age") == nil {
+		defineSettings(flag.CommandLine, new(settings))
+	}
+	defer func() {
+		configFile, commandLine = "", nil
+		loadedSettings.Store(defaultSettings)
+	}()
+	commandLine = map[string]string{"max-age": "5m"}
+
+	if err := reloadTestConfig(t, "block-domains example.com\nmax-age 1h\nerror-ttl 2m\n"); err != nil {
+		t.Fatal(err)
+	}
+	s := currentSettings()
+	if checkHost("example.com") != ErrBlockedDomain {
+		t.Errorf("the blocked domains are not reloaded")
+	}
+	if s.errorTTL != 2*time.Minute {
+		t.Errorf("errorTTL = %s, want 2m", s.errorTTL)
+	}
+	if s.maxAge != 5*time.Minute {
+		t.Errorf("maxAge = %s, the command-line must take precedence", s.maxAge)
+	}
+
+	// An invalid option doesn't change anything
+	if err := reloadTestConfig(t, "block-domains other.example\nerror-ttl forever\n"); err == nil {
+		t.Fatalf("an invalid duration is accepted")
+	}
+	if currentSettings() != s {
+		t.Errorf("a failed reload has changed the settings")
+	}
+
+	// The options removed from the file get their default value back
+	if err := reloadTestConfig(t, "rate-limit 10\n"); err != nil {
+		t.Fatal(err)
+	}
+	if checkHost("example.com") != nil {
+		t.Errorf("example.com is still blocked")
+	}
+	if s := currentSettings(); s.errorTTL != CacheRefreshInterval || s.rateLimit != 10 {
+		t.Errorf("errorTTL = %s and rateLimit = %g", s.errorTTL, s.rateLimit)
+	}
+}
+
+func TestReloadTimeouts(t *testing.T) {
+	if flag.Lookup("max-age") == nil {
+		defineSettings(flag.CommandLine, new(settings))
+	}
+	defer func() {
+		configFile, commandLine = "", nil
+		loadedSettings.Store(defaultSettings)
+	}()
+
+	if err := reloadTestConfig(t, "header-timeout 3s\nfetch-timeout 1m\nlog-level warning\n"); err != nil {
+		t.Fatal(err)
+	}
+	s := currentSettings()
+	if s.timeouts.Header != 3*time.Second || s.timeouts.Total != time.Minute {
+		t.Errorf("timeouts = %+v, the timeouts are not reloaded", s.timeouts)
+	}
+	if s.logLevel != "warning" {
+		t.Errorf("logLevel = %s, want warning", s.logLevel)
+	}
+
+	if err := reloadTestConfig(t, "log-level debug\n"); err == nil {
+		t.Errorf("an unknown log level is accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The header with the ID of a request, shared with nginx and the distant servers
+const RequestIDHeader = "X-Request-Id"
+
+// The type of the keys for the values of the contexts
+type contextKey int
+
+// The key for the ID of the request in a context
+const requestIDKey contextKey = 0
+
+// A valid request ID from nginx is short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= 0x20 || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Give an ID to each request (or use the one given by nginx),
+// and send it back in the response
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// The ID of the request for a context (empty for the background tasks)
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// A context for fetching an image, with the ID of the request and its trace,
+// but not its cancellation: the fetch can be shared with other requests
+func fetchContext(r *http.Request) context.Context {
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+	return context.WithValue(ctx, requestIDKey, requestID(r.Context()))
+}
+
+// Log a line, prefixed by the ID of the request if there is one
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestID(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// Log a routine line, unless the log level is warning
+func infof(ctx context.Context, format string, args ...interface{}) {
+	if currentSettings().logLevel == "info" {
+		logf(ctx, format, args...)
+	}
+}
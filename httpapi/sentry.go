@@ -0,0 +1,144 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// The DSN of the Sentry-compatible service for reporting the errors (disabled if empty)
+var sentryDSN string
+
+// Where the events are sent, and how to authenticate, from the DSN
+var sentry struct {
+	storeURL string
+	auth     string
+	client   *http.Client
+}
+
+// Parse the DSN, https://key@host/project_id
+func setupSentry() error {
+	if sentryDSN == "" {
+		return nil
+	}
+	u, err := url.Parse(sentryDSN)
+	if err != nil {
+		return err
+	}
+	project := strings.Trim(u.Path, "/")
+	if u.User == nil || project == "" {
+		return errors.New("Invalid Sentry DSN, expected https://key@host/project_id")
+	}
+	sentry.storeURL = fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project)
+	sentry.auth = fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s/1.0, sentry_key=%s", ServiceName, u.User.Username())
+	sentry.client = &http.Client{Timeout: 10 * time.Second}
+	return nil
+}
+
+// An event for Sentry (only the fields we use)
+type sentryEvent struct {
+	EventID   string            `json:"event_id"`
+	Timestamp string            `json:"timestamp"`
+	Level     string            `json:"level"`
+	Platform  string            `json:"platform"`
+	Logger    string            `json:"logger"`
+	Message   string            `json:"message"`
+	Culprit   string            `json:"culprit,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Extra     map[string]string `json:"extra,omitempty"`
+}
+
+// Report an unexpected error, about the image at uri (can be empty).
+// The event is sent by a background worker, so it never slows the requests.
+func reportError(ctx context.Context, err error, uri string) {
+	if sentry.storeURL == "" || err == nil {
+		return
+	}
+	reportEvent(ctx, "error", err.Error(), uri, nil)
+}
+
+// Send an event to Sentry
+func reportEvent(ctx context.Context, level string, message string, uri string, extra map[string]string) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	event := sentryEvent{
+		EventID:   hex.EncodeToString(id),
+		Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:     level,
+		Platform:  "go",
+		Logger:    ServiceName,
+		Message:   message,
+		Culprit:   uri,
+		Tags:      map[string]string{"server_name": hostname},
+		Extra:     extra,
+	}
+	if rid := requestID(ctx); rid != "" {
+		event.Tags["request_id"] = rid
+	}
+	if uri != "" {
+		if event.Extra == nil {
+			event.Extra = make(map[string]string)
+		}
+		event.Extra["url"] = uri
+	}
+	enqueue(func() { sendEvent(event) })
+}
+
+// POST the event to the store endpoint of Sentry
+func sendEvent(event sentryEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", sentry.storeURL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", sentry.auth)
+	res, err := sentry.client.Do(req)
+	if err != nil {
+		log.Printf("Error while reporting to Sentry: %s\n", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Printf("Error while reporting to Sentry: status code %d\n", res.StatusCode)
+	}
+}
+
+// Recover from the panics in the handlers: they are reported with the
+// stack trace, and the client gets a 500
+func withRecovery(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				stack := string(debug.Stack())
+				logf(r.Context(), "Panic on %s: %v\n%s", r.URL, p, stack)
+				if sentry.storeURL != "" {
+					reportEvent(r.Context(), "fatal", fmt.Sprintf("panic: %v", p), "", map[string]string{
+						"request": r.Method + " " + r.URL.String(),
+						"stack":   stack,
+					})
+				}
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
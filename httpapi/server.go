@@ -0,0 +1,59 @@
+package httpapi
+
+import (
+	"net/http"
+
+	"github.com/bmizerany/pat"
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+	"github.com/linuxfrorg/img-LinuxFr.org/fetcher"
+)
+
+// Server serves the images and the avatars: their metadata are in redis,
+// under keyPrefix, their files in the store, and they are fetched on the
+// distant servers by the fetcher
+type Server struct {
+	redis     cache.RedisClient
+	store     cache.Store
+	keyPrefix string
+	fetcher   *fetcher.Fetcher
+}
+
+// NewServer makes a server with these dependencies
+func NewServer(redis cache.RedisClient, store cache.Store, keyPrefix string, f *fetcher.Fetcher) *Server {
+	return &Server{redis: redis, store: store, keyPrefix: keyPrefix, fetcher: f}
+}
+
+// Handler routes the requests to the handlers of the server
+func (srv *Server) Handler() http.Handler {
+	m := pat.New()
+	m.Get("/status", http.HandlerFunc(Status))
+	m.Get("/healthz", http.HandlerFunc(srv.Healthz))
+	m.Get("/livez", http.HandlerFunc(Livez))
+	m.Get("/readyz", http.HandlerFunc(srv.Readyz))
+	m.Get("/admin/meta/:encoded_url", adminOnly(srv.Meta))
+	if placeholders {
+		m.Get("/placeholders/:encoded_url", http.HandlerFunc(srv.Placeholder))
+	}
+	if urlSecret != "" {
+		m.Get("/img/:digest/:encoded_url/:filename", signedOnly(srv.Img))
+		m.Get("/img/:digest/:encoded_url", signedOnly(srv.Img))
+		m.Get("/avatars/:digest/:encoded_url/:filename", signedOnly(srv.Avatar))
+		m.Get("/avatars/:digest/:encoded_url", signedOnly(srv.Avatar))
+	} else {
+		m.Get("/img/:encoded_url/:filename", http.HandlerFunc(srv.Img))
+		m.Get("/img/:encoded_url", http.HandlerFunc(srv.Img))
+		m.Get("/avatars/:encoded_url/:filename", http.HandlerFunc(srv.Avatar))
+		m.Get("/avatars/:encoded_url", http.HandlerFunc(srv.Avatar))
+	}
+	m.Del("/img/:encoded_url", adminOnly(srv.Purge))
+	m.Post("/admin/block", adminOnly(srv.Block))
+	m.Post("/admin/unblock", adminOnly(srv.Unblock))
+	m.Post("/admin/block-checksum", adminOnly(srv.BlockChecksum))
+	m.Post("/admin/unblock-checksum", adminOnly(srv.UnblockChecksum))
+	m.Post("/admin/blur", adminOnly(srv.Blur))
+	m.Post("/admin/unblur", adminOnly(srv.Unblur))
+	m.Get("/admin/stats", adminOnly(srv.Stats))
+	m.Post("/prefetch", adminOnly(srv.Prefetch))
+	m.Get("/prefetch/:job", adminOnly(PrefetchJob))
+	return m
+}
@@ -0,0 +1,78 @@
+package httpapi
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The number of levels of directories for the cached files
+var shardDepth int
+
+// The hash of the URLs for the keys of the cached files (sha1 or sha256)
+var shardHash string
+
+// The layout of the cache before it could be configured
+const LegacyShardDepth, LegacyShardHash = 3, "sha1"
+
+// Check the layout of the cache given by the flags
+func checkSharding() error {
+	if shardHash != "sha1" && shardHash != "sha256" {
+		return errors.New("Unknown hash for the cache keys: " + shardHash)
+	}
+	if shardDepth < 0 || shardDepth > 8 {
+		return errors.New("The depth of the cache directories must be between 0 and 8")
+	}
+	return nil
+}
+
+// The key for s, with one level of directories per byte of its hash for
+// the first depth bytes, to avoid having too many files in the same directory
+func shardedKey(s string, hash string, depth int) string {
+	var sum []byte
+	if hash == "sha256" {
+		h := sha256.Sum256([]byte(s))
+		sum = h[:]
+	} else {
+		h := sha1.Sum([]byte(s))
+		sum = h[:]
+	}
+	parts := make([]string, 0, depth+1)
+	for i := 0; i < depth; i++ {
+		parts = append(parts, fmt.Sprintf("%x", sum[i:i+1]))
+	}
+	parts = append(parts, fmt.Sprintf("%x", sum[depth:]))
+	return strings.Join(parts, "/")
+}
+
+// The key for s with the legacy layout of the cache
+func legacyKeyForCache(s string) string {
+	return shardedKey(s, LegacyShardHash, LegacyShardDepth)
+}
+
+// The key in the store for the body of the image cached for uri, without
+// dedup. The images cached before a change of layout are still read with
+// the legacy key, until they are refreshed.
+func (srv *Server) uriKey(uri string) string {
+	key := generateKeyForCache(uri)
+	legacy := legacyKeyForCache(uri)
+	if key == legacy {
+		return key
+	}
+	if _, err := srv.store.Stat(key); err != nil {
+		if _, err := srv.store.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return key
+}
+
+// Remove the file of the image cached for uri with the legacy layout, if the
+// layout has changed
+func (srv *Server) removeLegacyFile(uri string, del func(key string) error) {
+	if legacy := legacyKeyForCache(uri); legacy != generateKeyForCache(uri) {
+		del(legacy)
+	}
+}
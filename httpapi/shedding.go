@@ -0,0 +1,81 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The maximal number of requests handled at the same time (0 for no limit)
+var maxRequests int
+
+// The maximal number of fetches from the distant servers at the same time
+// (0 for no limit)
+var maxFetches int
+
+// The slots for the requests and the fetches in progress
+var requestSlots, fetchSlots chan struct{}
+
+// How long the clients should wait before retrying when we are overloaded
+const OverloadRetryAfter = 1 * time.Second
+
+// The error when there are too many fetches in progress
+var ErrOverloaded = errors.New("Too many fetches in progress")
+
+// The paths that are never refused, for the monitoring
+var unlimitedPaths = map[string]bool{
+	"/status":  true,
+	"/healthz": true,
+	"/livez":   true,
+	"/readyz":  true,
+}
+
+// Create the slots for the requests and the fetches
+func startLoadShedding() {
+	if maxRequests > 0 {
+		requestSlots = make(chan struct{}, maxRequests)
+	}
+	if maxFetches > 0 {
+		fetchSlots = make(chan struct{}, maxFetches)
+	}
+}
+
+// Take a slot without waiting, and return false if they are all taken
+func acquireSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Give back a slot taken by acquireSlot
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// Respond immediately with a 503 when there are too many requests in
+// progress, instead of queueing them until the memory or the file
+// descriptors are exhausted
+func withLoadShedding(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !acquireSlot(requestSlots) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(OverloadRetryAfter/time.Second)))
+			http.Error(w, "Too many requests in progress", http.StatusServiceUnavailable)
+			return
+		}
+		defer releaseSlot(requestSlots)
+		handler.ServeHTTP(w, r)
+	})
+}
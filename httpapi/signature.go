@@ -0,0 +1,46 @@
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+)
+
+// The shared secret for signing the URLs of the images (disabled if empty).
+// It is compatible with camo: the paths are /img/<hmac>/<hex_url>, where hmac
+// is the hex-encoded HMAC-SHA1 of the URL with this secret.
+var urlSecret string
+
+// Compute the signature of uri with the shared secret
+func signURL(uri string) string {
+	h := hmac.New(sha1.New, []byte(urlSecret))
+	h.Write([]byte(uri))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Check that the :digest parameter is the signature of the :encoded_url one
+func validSignature(r *http.Request) bool {
+	query := r.URL.Query()
+	chars, err := hex.DecodeString(query.Get(":encoded_url"))
+	if err != nil {
+		return false
+	}
+	digest, err := hex.DecodeString(query.Get(":digest"))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(signURL(string(chars)))
+	return hmac.Equal(digest, expected)
+}
+
+// Only call the handler for the requests with a valid signature
+func signedOnly(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validSignature(r) {
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package httpapi
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The first file descriptor passed by systemd for socket activation
+const SystemdListenFdsStart = 3
+
+// Give the socket passed by systemd (socket activation), or nil if there is none
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if nfds > 1 {
+		log.Printf("systemd has passed %d sockets, only the first one is used\n", nfds)
+	}
+
+	f := os.NewFile(SystemdListenFdsStart, "systemd")
+	defer f.Close()
+	log.Printf("Use the listening socket from systemd\n")
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is managed by systemd
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return ln, nil
+}
+
+// Send a state to systemd (READY=1, STOPPING=1, WATCHDOG=1, etc.),
+// if the service has been started with Type=notify
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	// Abstract namespace
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Error while notifying systemd: %s\n", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		log.Printf("Error while notifying systemd: %s\n", err)
+	}
+}
+
+// Tell systemd that we are ready to serve the requests. After an upgrade,
+// the main PID of the service has changed (it needs NotifyAccess=all).
+func sdReady() {
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+}
+
+// Ping the watchdog of systemd, twice per interval given by WatchdogSec
+func startWatchdog() {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		for range time.Tick(interval) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
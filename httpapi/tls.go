@@ -0,0 +1,81 @@
+package httpapi
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Don't look for a new certificate on disk more than once per minute
+const CertCheckInterval = 1 * time.Minute
+
+// A TLS certificate that is reloaded when its files are changed on disk
+// (after a renewal by certbot for example)
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// Load the certificate and its key for the first time
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Read the certificate and its key from the disk
+func (c *certReloader) reload() error {
+	modTime, err := c.lastModification()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// The most recent mtime of the certificate and key files
+func (c *certReloader) lastModification() (modTime time.Time, err error) {
+	for _, filename := range []string{c.certFile, c.keyFile} {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return modTime, err
+		}
+		if stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+	return
+}
+
+// Give the certificate to use for a TLS handshake (see tls.Config)
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checkedAt) > CertCheckInterval {
+		c.checkedAt = time.Now()
+		modTime, err := c.lastModification()
+		if err == nil && modTime.After(c.modTime) {
+			if err = c.reload(); err != nil {
+				log.Printf("Error while reloading the TLS certificate: %s\n", err)
+			} else {
+				log.Printf("The TLS certificate has been reloaded\n")
+			}
+		}
+	}
+
+	return c.cert, nil
+}
@@ -0,0 +1,80 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name of the service in the traces
+const ServiceName = "img-LinuxFr.org"
+
+// The URL of the OTLP/HTTP collector for the traces (disabled if empty)
+var otlpEndpoint string
+
+// The tracer for the spans of the daemon. It does nothing until
+// setupTracing has registered a provider.
+var tracer = otel.Tracer(ServiceName)
+
+// Export the traces to the OTLP collector, and give the function
+// to call to flush them before exiting
+func setupTracing() (shutdown func(), err error) {
+	if otlpEndpoint == "" {
+		return func() {}, nil
+	}
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(otlpEndpoint))
+	if err != nil {
+		return
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() { provider.Shutdown(ctx) }, nil
+}
+
+// Start a span for each request, continuing the trace of nginx if any
+func withTracing(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+				attribute.String("request.id", requestID(r.Context())),
+			))
+		defer span.End()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Start a span for a step of a request (redis, disk, distant server)
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Add the headers to continue the trace on the distant server
+func injectTrace(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// End a span, with the error of the step if it has failed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,37 @@
+package httpapi
+
+import (
+	"net/http"
+	"time"
+)
+
+// The image served instead of the broken or unavailable images, so the
+// pages don't show the icon of a broken image (nil for none)
+var unavailableImage *localImage
+
+// How long the clients can cache the image for an unavailable image, short
+// as the image may come back
+var unavailableMaxAge time.Duration
+
+// Respond with the image for the unavailable images, and the status code.
+// It returns false if there is no such image.
+func serveUnavailableImage(w http.ResponseWriter, r *http.Request, status int) bool {
+	if unavailableImage == nil {
+		return false
+	}
+	w.Header().Set("Content-Type", unavailableImage.contentType)
+	w.Header().Set("Cache-Control", publicCacheControl(unavailableMaxAge))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(unavailableImage.body)
+	}
+	return true
+}
+
+// Respond with a 404 when an image can't be found, with the image for the
+// unavailable images if there is one
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if !serveUnavailableImage(w, r, http.StatusNotFound) {
+		http.NotFound(w, r)
+	}
+}
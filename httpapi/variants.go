@@ -0,0 +1,169 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+	"golang.org/x/sync/singleflight"
+)
+
+// The maximal quality of the JPEG variants asked with the q parameter
+// (0 to disable the variants)
+var maxQuality int
+
+// The qualities are rounded to a multiple of this step, to keep the number
+// of cached variants small
+const QualityStep = 5
+
+// Only one transcoding at a time for each variant
+var variantGroup singleflight.Group
+
+// The quality asked with the q parameter, bounded by maxQuality,
+// or 0 for the original image
+func requestedQuality(r *http.Request) int {
+	if maxQuality <= 0 {
+		return 0
+	}
+	q, err := strconv.Atoi(r.URL.Query().Get("q"))
+	if err != nil || q <= 0 {
+		return 0
+	}
+	if q > maxQuality {
+		q = maxQuality
+	}
+	q = q / QualityStep * QualityStep
+	if q < QualityStep {
+		q = QualityStep
+	}
+	return q
+}
+
+// The highest quality of a JPEG image
+const MaxJPEGQuality = 100
+
+// The suffix of the key in the store for the variant with the given quality
+func qualitySuffix(quality int) string {
+	return ".q" + strconv.Itoa(quality)
+}
+
+// The suffix of the key in the store for the blurred variant
+const BlurSuffix = ".blur"
+
+// The key in the store for a variant of uri. The variants belong to uri,
+// even if its body is a blob shared with dedup, so they are deleted with it.
+func variantKey(uri string, suffix string) string {
+	return generateKeyForCache(uri) + suffix
+}
+
+// The suffixes of all the variants that can be cached for an image,
+// including the qualities above the current maxQuality
+func variantSuffixes() []string {
+	suffixes := []string{BlurSuffix}
+	for q := QualityStep; q <= MaxJPEGQuality; q += QualityStep {
+		suffixes = append(suffixes, qualitySuffix(q))
+	}
+	return suffixes
+}
+
+// Register a variant of uri written in the store, so it counts in the size
+// of the cache. Its size is kept in the hash of uri, in a variant.* field.
+func (srv *Server) registerVariant(uri string, suffix string, size int64) {
+	field := "variant" + suffix
+	var previous int64
+	if hget := srv.redis.HGet(srv.keyPrefix+uri, field); hget.Err() == nil {
+		previous, _ = strconv.ParseInt(hget.Val(), 10, 64)
+	}
+	srv.redis.HSet(srv.keyPrefix+uri, field, strconv.FormatInt(size, 10))
+	srv.redis.IncrBy(srv.keyPrefix+"size", size-previous)
+}
+
+// Delete the variants of uri from the store with del, and give their total size
+func (srv *Server) deleteVariants(uri string, del func(key string) error) (size int64) {
+	for _, suffix := range variantSuffixes() {
+		field := "variant" + suffix
+		hget := srv.redis.HGet(srv.keyPrefix+uri, field)
+		if hget.Err() != nil {
+			continue
+		}
+		n, _ := strconv.ParseInt(hget.Val(), 10, 64)
+		size += n
+		if err := del(variantKey(uri, suffix)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error while deleting the variant %s of %s: %s\n", suffix, uri, err)
+		}
+		srv.redis.HDel(srv.keyPrefix+uri, field)
+	}
+	return
+}
+
+// The key in the store of the original image, for the key of a variant.
+// The keys of the originals are only made of hex digits and slashes.
+func originalKey(key string) string {
+	if i := strings.Index(key, "."); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Give the variant of a JPEG image with the quality asked by the client
+func (srv *Server) qualityVariant(ctx context.Context, uri string, quality int, headers *Headers, body io.ReadSeekCloser) io.ReadSeekCloser {
+	if quality == 0 || headers.contentType != "image/jpeg" {
+		return body
+	}
+	variant, err := srv.cachedVariant(ctx, uri, qualitySuffix(quality), headers, body, func(original []byte) ([]byte, error) {
+		return transcodeJPEG(original, quality, progressiveJPEG)
+	})
+	if err != nil {
+		logf(ctx, "Error while transcoding %s: %s\n", uri, err)
+		body.Seek(0, io.SeekStart)
+		return body
+	}
+	body.Close()
+	if headers.etag != "" {
+		headers.etag = strings.TrimSuffix(headers.etag, `"`) + "-q" + strconv.Itoa(quality) + `"`
+	}
+	return variant
+}
+
+// Give a variant of an image. It is read from the store, or made by
+// transform from the original image and saved in the store if it is
+// missing or older than the original.
+func (srv *Server) cachedVariant(ctx context.Context, uri string, suffix string, headers *Headers, body io.Reader, transform func([]byte) ([]byte, error)) (io.ReadSeekCloser, error) {
+	key := variantKey(uri, suffix)
+	modTime, _ := http.ParseTime(headers.lastModified)
+	variant, mtime, err := srv.store.Open(key)
+	if err == nil && !mtime.Before(modTime) {
+		return variant, nil
+	}
+	if err == nil {
+		variant.Close()
+	}
+
+	v, err, _ := variantGroup.Do(key, func() (interface{}, error) {
+		all, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		transformed, err := transform(all)
+		if err != nil {
+			return nil, err
+		}
+		if err = srv.store.Put(key, bytes.NewReader(transformed)); err != nil {
+			logf(ctx, "Error while writing the variant of %s: %s\n", uri, err)
+		} else {
+			srv.registerVariant(uri, suffix, int64(len(transformed)))
+		}
+		return transformed, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cache.NewBytesFile(v.([]byte)), nil
+}
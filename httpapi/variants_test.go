@@ -0,0 +1,109 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linuxfrorg/img-LinuxFr.org/cache"
+)
+
+func TestVariantsEvictedWithImage(t *testing.T) {
+	srv := setupCache(t)
+	uri := "http://a.example/1.jpg"
+	saveTestImage(t, srv, uri, "original body")
+	headers := &Headers{lastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}
+
+	variant, err := srv.cachedVariant(context.Background(), uri, qualitySuffix(60), headers, strings.NewReader("original body"), func(original []byte) ([]byte, error) {
+		return []byte("smaller"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	variant.Close()
+	if n := redisInt(t, srv, "size"); n != int64(len("original body")+len("smaller")) {
+		t.Errorf("cache size = %d, the variant is not counted", n)
+	}
+
+	srv.evictFromCache(uri)
+	if _, err := srv.store.Stat(variantKey(uri, qualitySuffix(60))); !os.IsNotExist(err) {
+		t.Errorf("the variant is still in the store: %v", err)
+	}
+	if n := redisInt(t, srv, "size"); n != 0 {
+		t.Errorf("cache size = %d after the eviction, want 0", n)
+	}
+}
+
+// A store that counts the bodies it opens and that are still open
+type openCountingStore struct {
+	cache.Store
+	open *int32
+}
+
+type countedBody struct {
+	io.ReadSeekCloser
+	open   *int32
+	closed int32
+}
+
+// A body closed twice is only counted once
+func (b *countedBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		atomic.AddInt32(b.open, -1)
+	}
+	return b.ReadSeekCloser.Close()
+}
+
+func (s openCountingStore) Open(key string) (io.ReadSeekCloser, time.Time, error) {
+	body, modTime, err := s.Store.Open(key)
+	if err != nil {
+		return nil, modTime, err
+	}
+	atomic.AddInt32(s.open, 1)
+	return &countedBody{ReadSeekCloser: body, open: s.open}, modTime, nil
+}
+
+func TestServedVariantsAreClosed(t *testing.T) {
+	srv := setupCache(t)
+	defer func(q int) { maxQuality = q }(maxQuality)
+	maxQuality = 80
+
+	uri := "http://a.example/1.jpg"
+	srv.redis.HSet(srv.keyPrefix+uri, "created_at", "1")
+	if err := srv.saveImageInCache(context.Background(), uri, "image/jpeg", strings.NewReader("original body")); err != nil {
+		t.Fatal(err)
+	}
+	transform := func(original []byte) ([]byte, error) { return []byte("variant"), nil }
+	for _, suffix := range []string{qualitySuffix(60), BlurSuffix} {
+		variant, err := srv.cachedVariant(context.Background(), uri, suffix, &Headers{}, strings.NewReader("original body"), transform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		variant.Close()
+	}
+
+	var open int32
+	srv.store = openCountingStore{srv.store, &open}
+	encoded := hex.EncodeToString([]byte(uri))
+	for _, query := range []string{"q=60", "unblur=0"} {
+		if query == "unblur=0" {
+			srv.redis.HSet(srv.keyPrefix+uri, "nsfw", "1")
+		}
+		r := httptest.NewRequest("GET", "/img/"+encoded+"?"+query+"&:encoded_url="+encoded, nil)
+		w := httptest.NewRecorder()
+		srv.Img(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "variant" {
+			t.Fatalf("%s: %d %q, want the variant", query, w.Code, w.Body.String())
+		}
+		if n := atomic.LoadInt32(&open); n != 0 {
+			t.Errorf("%s: %d bodies are not closed", query, n)
+		}
+	}
+}
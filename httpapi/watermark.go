@@ -0,0 +1,81 @@
+package httpapi
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// The text written on the large images, {host} being replaced by the host
+// of the image (disabled if empty)
+var watermark string
+
+// The minimal width of the images with a watermark, in pixels
+var watermarkMinWidth int
+
+// The space around the text of the watermark, in pixels
+const WatermarkPadding = 4
+
+// Write the watermark in the bottom right corner of a JPEG or PNG image.
+// The other formats, and the small images, are not modified.
+func watermarkImage(uri string, body []byte) []byte {
+	contentType := http.DetectContentType(body)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return body
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil || config.Width < watermarkMinWidth {
+		return body
+	}
+	img, _, err := decodeImage(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+
+	text := watermark
+	if u, err := url.Parse(uri); err == nil {
+		text = strings.Replace(text, "{host}", u.Hostname(), -1)
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	drawWatermark(rgba, text)
+
+	var out []byte
+	if contentType == "image/jpeg" {
+		out, err = encodeJPEG(rgba, body, jpegQuality, progressiveJPEG)
+	} else {
+		var buf bytes.Buffer
+		err = png.Encode(&buf, rgba)
+		out = buf.Bytes()
+	}
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// Draw the text, white on a translucent black box, in the bottom right corner
+func drawWatermark(img *image.RGBA, text string) {
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: img, Src: image.White, Face: face}
+	metrics := face.Metrics()
+	width := d.MeasureString(text).Ceil() + 2*WatermarkPadding
+	height := metrics.Height.Ceil() + 2*WatermarkPadding
+
+	bounds := img.Bounds()
+	box := image.Rect(bounds.Max.X-width, bounds.Max.Y-height, bounds.Max.X, bounds.Max.Y).Intersect(bounds)
+	shade := image.NewUniform(color.RGBA{0, 0, 0, 0x80})
+	draw.Draw(img, box, shade, image.Point{}, draw.Over)
+
+	d.Dot = fixed.P(box.Min.X+WatermarkPadding, box.Min.Y+WatermarkPadding+metrics.Ascent.Ceil())
+	d.DrawString(text)
+}
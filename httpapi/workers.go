@@ -0,0 +1,62 @@
+package httpapi
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// The number of workers for the background tasks
+var backgroundWorkers int
+
+// The maximal number of background tasks waiting for a worker
+var backgroundQueueSize int
+
+// The queue of the background tasks (refreshes and writes in the cache)
+var backgroundTasks chan func()
+
+// The number of tasks dropped because the queue was full
+var droppedTasks int64
+
+// The tasks in the queue or in progress
+var pendingTasks sync.WaitGroup
+
+// Start the workers for the background tasks
+func startWorkers() {
+	backgroundTasks = make(chan func(), backgroundQueueSize)
+	for i := 0; i < backgroundWorkers; i++ {
+		go func() {
+			for task := range backgroundTasks {
+				task()
+				pendingTasks.Done()
+			}
+		}()
+	}
+}
+
+// Add a task to the queue. When the queue is full, the task is dropped:
+// we prefer losing a refresh or an error in the cache to piling up
+// goroutines and file descriptors during a traffic spike.
+func enqueue(task func()) bool {
+	pendingTasks.Add(1)
+	select {
+	case backgroundTasks <- task:
+		return true
+	default:
+		pendingTasks.Done()
+		if atomic.AddInt64(&droppedTasks, 1)%100 == 1 {
+			log.Printf("The queue of background tasks is full (%d dropped)\n", atomic.LoadInt64(&droppedTasks))
+		}
+		return false
+	}
+}
+
+// Wait for the end of the tasks in the queue, before exiting
+func drainQueue() {
+	pendingTasks.Wait()
+}
+
+// The number of tasks waiting for a worker
+func queueDepth() int {
+	return len(backgroundTasks)
+}
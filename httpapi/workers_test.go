@@ -0,0 +1,28 @@
+package httpapi
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainQueue(t *testing.T) {
+	defer func(tasks chan func(), workers, size int) {
+		backgroundTasks, backgroundWorkers, backgroundQueueSize = tasks, workers, size
+	}(backgroundTasks, backgroundWorkers, backgroundQueueSize)
+	backgroundWorkers, backgroundQueueSize = 2, 10
+	startWorkers()
+
+	var done int32
+	for i := 0; i < 5; i++ {
+		enqueue(func() {
+			time.Sleep(10 * time.Millisecond)
+			// A task can queue another one while the queue is drained
+			enqueue(func() { atomic.AddInt32(&done, 1) })
+		})
+	}
+	drainQueue()
+	if n := atomic.LoadInt32(&done); n != 5 {
+		t.Errorf("%d tasks done before the exit, want 5", n)
+	}
+}